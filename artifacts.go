@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	slashpath "path"
+)
+
+// artifactStore keeps the files that stages copied out of their containers
+// so they can be copied into the containers of later stages. Artifacts are
+// stored as the tar archives produced by docker cp so file modes and
+// ownership survive the round trip.
+type artifactStore struct {
+	dir     string
+	runtime Runtime
+	saved   map[string]bool
+}
+
+func newArtifactStore(rt Runtime) (*artifactStore, error) {
+	dir, err := ioutil.TempDir("", "lope-artifacts")
+	if err != nil {
+		return nil, err
+	}
+	return &artifactStore{
+		dir:     dir,
+		runtime: rt,
+		saved:   make(map[string]bool),
+	}, nil
+}
+
+func (a *artifactStore) remove() {
+	os.RemoveAll(a.dir)
+}
+
+func (a *artifactStore) file(artifact string) string {
+	return filepath.Join(a.dir, hex.EncodeToString([]byte(artifactKey(artifact)))+".tar")
+}
+
+// artifactKey normalises an artifact path so that "bin/app" and "./bin/app"
+// refer to the same artifact
+func artifactKey(artifact string) string {
+	return slashpath.Clean(artifact)
+}
+
+// containerPath resolves an artifact path inside of the container. Relative
+// paths are relative to the working directory of the stage.
+func containerPath(workDir string, artifact string) string {
+	if strings.HasPrefix(artifact, "/") {
+		return slashpath.Clean(artifact)
+	}
+	return slashpath.Join(workDir, artifact)
+}
+
+// save copies an artifact out of a finished container
+func (a *artifactStore) save(container string, workDir string, artifact string) error {
+	file, err := os.Create(a.file(artifact))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src := containerPath(workDir, artifact)
+	if err := a.runtime.CopyFrom(container, src, file); err != nil {
+		return fmt.Errorf("failed to copy artifact %q out of the container: %v", artifact, err)
+	}
+	a.saved[artifactKey(artifact)] = true
+	return nil
+}
+
+// inject copies an artifact saved by an earlier stage into a created container
+func (a *artifactStore) inject(container string, workDir string, input string) error {
+	if !a.saved[artifactKey(input)] {
+		return fmt.Errorf("input %q was not produced by an earlier stage in this run", input)
+	}
+
+	file, err := os.Open(a.file(input))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var archive bytes.Buffer
+	dest := containerPath(workDir, input)
+	if err := relocateArchive(file, &archive, slashpath.Base(artifactKey(input)), dest); err != nil {
+		return err
+	}
+
+	if err := a.runtime.CopyTo(container, &archive); err != nil {
+		return fmt.Errorf("failed to copy input %q into the container: %v", input, err)
+	}
+	return nil
+}
+
+// relocateArchive rewrites an archive created by docker cp, where every entry
+// starts with the base name of the copied path, so that it can be extracted
+// at the root of the filesystem and end up at dest.
+func relocateArchive(r io.Reader, w io.Writer, base string, dest string) error {
+	prefix := strings.TrimPrefix(dest, "/")
+	rename := func(name string) string {
+		return prefix + strings.TrimPrefix(name, base)
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		h.Name = rename(h.Name)
+		if h.Typeflag == tar.TypeLink {
+			h.Linkname = rename(h.Linkname)
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func randomID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestContainerPath(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		workDir     string
+		artifact    string
+		want        string
+	}{
+		{
+			"Relative paths are inside of the working directory",
+			"/lope",
+			"bin/app",
+			"/lope/bin/app",
+		},
+		{
+			"Absolute paths are used as is",
+			"/lope",
+			"/usr/local/bin/app",
+			"/usr/local/bin/app",
+		},
+		{
+			"Paths are cleaned",
+			"/lope",
+			"./bin/../dist/",
+			"/lope/dist",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := containerPath(test.workDir, test.artifact)
+			if got != test.want {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRelocateArchive(t *testing.T) {
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	tw.WriteHeader(&tar.Header{Name: "dist/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dist/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "dist/link", Typeflag: tar.TypeLink, Linkname: "dist/app"})
+	tw.Close()
+
+	var out bytes.Buffer
+	if err := relocateArchive(&in, &out, "dist", "/src/build"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	tr := tar.NewReader(&out)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, h.Name+":"+h.Linkname)
+	}
+	want := []string{"src/build/:", "src/build/app:", "src/build/link:src/build/app"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces argument values that match a secret pattern
+const redacted = "[REDACTED]"
+
+// auditEntry is a line of the audit log of the command proxy. Exit is -1 for
+// commands that were refused and 127 for commands that couldn't be started.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Session     string    `json:"session"`
+	Image       string    `json:"image"`
+	Command     string    `json:"command"`
+	Args        []string  `json:"args"`
+	Dir         string    `json:"dir"`
+	HostDir     string    `json:"hostDir"`
+	Allowed     bool      `json:"allowed"`
+	Exit        int       `json:"exit"`
+	DurationMs  int64     `json:"durationMs"`
+	OutputBytes int64     `json:"outputBytes"`
+}
+
+// auditLog writes a JSON line for every command the command proxy is asked
+// to run. A nil auditLog doesn't write anything.
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	session string
+	image   string
+	redact  []*regexp.Regexp
+}
+
+// compileRedact checks the patterns of arguments that are redacted
+func compileRedact(patterns []string) ([]*regexp.Regexp, error) {
+	redact := []*regexp.Regexp{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %v", p, err)
+		}
+		redact = append(redact, re)
+	}
+	return redact, nil
+}
+
+// newAuditLog appends to file so that the log of earlier sessions is kept
+func newAuditLog(file string, redact []string, session string, image string) (*auditLog, error) {
+	patterns, err := compileRedact(redact)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		file:    f,
+		session: session,
+		image:   image,
+		redact:  patterns,
+	}, nil
+}
+
+func (a *auditLog) close() error {
+	return a.file.Close()
+}
+
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	e.Session = a.session
+	e.Image = a.image
+	e.Args = a.redactArgs(e.Args)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		debug(fmt.Sprintf("Failed to write the audit log: %v\n", err))
+	}
+}
+
+// redactArgs hides arguments matching one of the secret patterns. For
+// arguments like --password=secret only the value after the = is hidden.
+func (a *auditLog) redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = arg
+		for _, re := range a.redact {
+			if !re.MatchString(arg) {
+				continue
+			}
+			if j := strings.Index(arg, "="); j != -1 {
+				out[i] = arg[:j+1] + redacted
+			} else {
+				out[i] = redacted
+			}
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	redact, err := compileRedact([]string{"(?i)password", "^ghp_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{redact: redact}
+
+	var tests = []struct {
+		description string
+		args        []string
+		want        []string
+	}{
+		{
+			"Arguments without secrets are kept",
+			[]string{"status", "--short"},
+			[]string{"status", "--short"},
+		},
+		{
+			"Only the value of a key=value argument is redacted",
+			[]string{"login", "--password=hunter2"},
+			[]string{"login", "--password=[REDACTED]"},
+		},
+		{
+			"Matching arguments without a key are redacted completely",
+			[]string{"auth", "ghp_abc123"},
+			[]string{"auth", "[REDACTED]"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := a.redactArgs(test.args)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	p, err := newProxyServer([]proxyRule{{Command: "echo"}, {Command: "lope-missing-command"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.audit, err = newAuditLog(file, []string{"secret"}, "abc123", "alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"command": "echo", "args": ["secret=1", "hi"], "dir": "/lope"}`,
+		`{"command": "rm", "args": ["-rf", "/"]}`,
+		`{"command": "lope-missing-command"}`,
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	p.audit.close()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	var tests = []struct {
+		description string
+		line        string
+		want        auditEntry
+	}{
+		{
+			"Commands that ran are recorded with their exit status and output",
+			lines[0],
+			auditEntry{
+				Session:     "abc123",
+				Image:       "alpine",
+				Command:     "echo",
+				Args:        []string{"secret=[REDACTED]", "hi"},
+				Dir:         "/lope",
+				Allowed:     true,
+				Exit:        0,
+				OutputBytes: 12,
+			},
+		},
+		{
+			"Refused commands are recorded too",
+			lines[1],
+			auditEntry{
+				Session: "abc123",
+				Image:   "alpine",
+				Command: "rm",
+				Args:    []string{"-rf", "/"},
+				Exit:    -1,
+			},
+		},
+		{
+			"Commands that can't be started exit with 127 like in a shell",
+			lines[2],
+			auditEntry{
+				Session:     "abc123",
+				Image:       "alpine",
+				Command:     "lope-missing-command",
+				Args:        []string{},
+				Allowed:     true,
+				Exit:        127,
+				OutputBytes: int64(len("lope: failed to run \"lope-missing-command\" on the host: exec: \"lope-missing-command\": executable file not found in $PATH\n")),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var got auditEntry
+			if err := json.Unmarshal([]byte(test.line), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Time.IsZero() {
+				t.Errorf("got time %v want the time of the request", got.Time)
+			}
+			got.Time = test.want.Time
+			got.DurationMs = 0
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
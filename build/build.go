@@ -23,6 +23,17 @@ var archs = [...]string{
 	"amd64",
 }
 
+// clientArchs are the architectures of the command proxy client that is
+// embedded into lope and installed in linux containers. lope installs the
+// client of its own architecture so this has to include every arch in archs.
+var clientArchs = [...]string{
+	"386",
+	"amd64",
+	"arm64",
+}
+
+var clientDir = filepath.FromSlash("cmdProxy/bin/")
+
 func checksum(goos string, goarch string) error {
 	file := buildDir + "lope-" + goos + "_" + goarch
 	f, err := os.Open(file)
@@ -67,7 +78,29 @@ func build(goos string, goarch string) error {
 	return cmd.Run()
 }
 
+// buildClient builds the command proxy client before lope so that it gets
+// embedded into every build of lope
+func buildClient(goarch string) error {
+	cmd := exec.Command(
+		"/usr/local/go/bin/go",
+		"build",
+		"-v",
+		"-o",
+		clientDir+"lope-proxy-linux_"+goarch,
+		"./cmdProxy",
+	)
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+goarch, "CGO_ENABLED=0")
+	return cmd.Run()
+}
+
 func main() {
+	for _, goarch := range clientArchs {
+		err := buildClient(goarch)
+		if err != nil {
+			log.Printf("Failed to build the command proxy client for linux/%s with error: %v", goarch, err)
+			os.Exit(1)
+		}
+	}
 	for _, goos := range operatingSystems {
 		for _, goarch := range archs {
 			err := build(goos, goarch)
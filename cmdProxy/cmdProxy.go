@@ -1,54 +1,211 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+
+	"github.com/Crazybus/lope/frame"
+	"golang.org/x/term"
 )
 
 type lopeCmd struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
+	TTY     bool     `json:"tty"`
+	Rows    uint16   `json:"rows"`
+	Cols    uint16   `json:"cols"`
+	Dir     string   `json:"dir"`
+	Env     []string `json:"env"`
 }
 
-func run(cmd string, args []string, url string) {
+// exitProxyError is used when the command couldn't be run on the host, like
+// ssh does when the connection fails
+const exitProxyError = 255
+
+// forwardSignals are sent to the command on the host instead of stopping the
+// client
+var forwardSignals = map[os.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGTERM: "SIGTERM",
+}
 
+func run(cmd string, args []string, addr string, token string) int {
+
+	// The host maps the directory and paths in the environment back to the
+	// host and decides which variables are passed on
+	dir, _ := os.Getwd()
 	lopeCmd := lopeCmd{
 		Command: cmd,
 		Args:    args,
+		Dir:     dir,
+		Env:     os.Environ(),
+	}
+
+	// Only allocate a terminal on the host when the client is attached to one
+	stdin := int(os.Stdin.Fd())
+	stdout := int(os.Stdout.Fd())
+	if term.IsTerminal(stdin) && term.IsTerminal(stdout) {
+		lopeCmd.TTY = true
+		if cols, rows, err := term.GetSize(stdout); err == nil {
+			lopeCmd.Rows = uint16(rows)
+			lopeCmd.Cols = uint16(cols)
+		}
 	}
 
 	b, err := json.Marshal(lopeCmd)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		return exitProxyError
+	}
+	network, address, target, err := endpoint(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitProxyError
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewBuffer(b))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitProxyError
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", frame.Upgrade)
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to reach the lope command proxy:", err)
+		return exitProxyError
+	}
+	defer conn.Close()
+
+	if err := req.Write(conn); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to reach the lope command proxy:", err)
+		return exitProxyError
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to reach the lope command proxy:", err)
+		return exitProxyError
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Fprint(os.Stderr, string(body))
+		return exitProxyError
+	}
+
+	if lopeCmd.TTY {
+		state, err := term.MakeRaw(stdin)
+		if err == nil {
+			defer term.Restore(stdin, state)
+		}
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	fw := frame.NewWriter(conn, nil)
+	go sendStdin(fw)
+	go sendSignals(fw, stdout)
+
+	return stream(br)
+}
+
+// endpoint parses the address of the command proxy which is either a
+// http://host:port or a unix:///path/to/socket URL. It returns what to dial
+// and the URL of the request.
+func endpoint(addr string) (string, string, string, error) {
+	u, err := url.Parse(addr)
 	if err != nil {
-		panic(err)
+		return "", "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		return "unix", u.Path, "http://lope/", nil
+	case "http":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return "tcp", host, addr, nil
 	}
-	defer resp.Body.Close()
+	return "", "", "", fmt.Errorf("unsupported LOPE_PROXY_ADDR %q, must be a http:// or unix:// URL", addr)
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	fmt.Print(string(body))
+// sendStdin forwards stdin to the command and closes its stdin at the end
+func sendStdin(fw *frame.Writer) {
+	io.Copy(fw.Stream(frame.Stdin), os.Stdin)
+	fw.Frame(frame.Stdin, nil)
+}
+
+// sendSignals forwards signals and changes of the terminal size
+func sendSignals(fw *frame.Writer, stdout int) {
+	sigs := make(chan os.Signal, 1)
+	for sig := range forwardSignals {
+		signal.Notify(sigs, sig)
+	}
+	notifyResize(sigs)
+
+	for sig := range sigs {
+		if name, ok := forwardSignals[sig]; ok {
+			fw.Frame(frame.Signal, []byte(name))
+			continue
+		}
+		if cols, rows, err := term.GetSize(stdout); err == nil {
+			fw.Frame(frame.Resize, frame.Size(uint16(rows), uint16(cols)))
+		}
+	}
+}
+
+// stream writes the output frames of the command to stdout and stderr and
+// returns the exit status from the last frame
+func stream(r io.Reader) int {
+	for {
+		kind, payload, err := frame.Read(r)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Lost the connection to the lope command proxy:", err)
+			return exitProxyError
+		}
+		switch kind {
+		case frame.Stdout:
+			os.Stdout.Write(payload)
+		case frame.Stderr:
+			os.Stderr.Write(payload)
+		case frame.Exit:
+			status, err := frame.ParseExitStatus(payload)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitProxyError
+			}
+			return status
+		}
+	}
 }
 
 func main() {
 	cmd := filepath.Base(os.Args[0])
 	args := os.Args[1:]
 
-	url, ok := os.LookupEnv("LOPE_PROXY_ADDR")
+	addr, ok := os.LookupEnv("LOPE_PROXY_ADDR")
 	if !ok {
 		fmt.Println("Please set the 'LOPE_PROXY_ADDR' environment variable")
 		os.Exit(1)
 	}
-	run(cmd, args, url)
+	token := os.Getenv("LOPE_PROXY_TOKEN")
+	if cmd == "lope-cp" {
+		os.Exit(copyFiles(args, addr, token))
+	}
+	os.Exit(run(cmd, args, addr, token))
 }
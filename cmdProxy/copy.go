@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const copyUsage = `usage: lope-cp SRC DEST
+
+Copies a file or a directory into a directory on the host or a file out of it.
+Paths on the host are written as NAME:PATH where NAME is one of the directories
+lope was started with -cmdProxyDir for.
+
+  lope-cp build/app.tar dist:      copies app.tar to the dist directory
+  lope-cp build dist:release       copies the build directory to dist/release
+  lope-cp dist:config.json .       copies config.json from the dist directory
+`
+
+// modeHeader carries the permissions of a copied file
+const modeHeader = "X-Lope-Mode"
+
+// copyFiles copies between the container and the host through the file
+// endpoints of the command proxy
+func copyFiles(args []string, addr string, token string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, copyUsage)
+		return 2
+	}
+	c, err := newCopyClient(addr, token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lope-cp:", err)
+		return exitProxyError
+	}
+
+	src, dst := args[0], args[1]
+	srcName, srcPath, srcHost := hostPath(src)
+	dstName, dstPath, dstHost := hostPath(dst)
+	switch {
+	case dstHost && !srcHost:
+		if dstPath == "" || strings.HasSuffix(dstPath, "/") {
+			dstPath += filepath.Base(src)
+		}
+		err = c.upload(src, dstName, dstPath)
+	case srcHost && !dstHost:
+		if info, statErr := os.Stat(dst); statErr == nil && info.IsDir() {
+			dst = filepath.Join(dst, filepath.Base(srcPath))
+		}
+		err = c.download(srcName, srcPath, dst)
+	default:
+		err = errors.New("exactly one of SRC and DEST has to be on the host, like dist:app.tar")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lope-cp:", err)
+		return 1
+	}
+	return 0
+}
+
+// hostPath splits NAME:PATH. Local paths with a colon can be written as
+// ./name:path.
+func hostPath(arg string) (string, string, bool) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], "/") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+type copyClient struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func newCopyClient(addr string, token string) (*copyClient, error) {
+	network, address, target, err := endpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Every request goes to the proxy, also for the unix socket
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	return &copyClient{
+		client: &http.Client{Transport: transport},
+		base:   strings.TrimSuffix(target, "/"),
+		token:  token,
+	}, nil
+}
+
+// url returns the URL of a path in one of the directories on the host
+func (c *copyClient) url(name string, p string) string {
+	segments := []string{url.PathEscape(name)}
+	for _, s := range strings.Split(p, "/") {
+		segments = append(segments, url.PathEscape(s))
+	}
+	return c.base + "/files/" + strings.Join(segments, "/")
+}
+
+// do sends the request and turns error responses into errors
+func (c *copyClient) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the lope command proxy: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// upload copies a file or everything in a directory to the host
+func (c *copyClient) upload(src string, name string, dst string) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		req, err := http.NewRequest("PUT", c.url(name, strings.TrimSuffix(dst+"/"+filepath.ToSlash(rel), "/.")), f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+		req.Header.Set(modeHeader, strconv.FormatUint(uint64(info.Mode().Perm()), 8))
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// download copies a file from the host
+func (c *copyClient) download(name string, src string, dst string) error {
+	req, err := http.NewRequest("GET", c.url(name, src), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	mode := os.FileMode(0644)
+	if m, err := strconv.ParseUint(resp.Header.Get(modeHeader), 8, 32); err == nil {
+		mode = os.FileMode(m).Perm()
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// notifyResize is a noop on windows which has no SIGWINCH
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const configFileName = ".lope.yml"
+
+// fileConfig is the structure of a .lope.yml file. Booleans are pointers so
+// that a key which is missing from the file can be told apart from false.
+type fileConfig struct {
+	Image        string   `yaml:"image"`
+	Command      string   `yaml:"command"`
+	Entrypoint   string   `yaml:"entrypoint"`
+	Dir          string   `yaml:"dir"`
+	WorkDir      string   `yaml:"workDir"`
+	Env          []string `yaml:"env"`
+	Blacklist    []string `yaml:"blacklist"`
+	Instructions []string `yaml:"instructions"`
+	Ignore       []string `yaml:"ignore"`
+	Context      string   `yaml:"context"`
+	Paths        []string `yaml:"paths"`
+	Args         []string `yaml:"args"`
+	Mount        *bool    `yaml:"mount"`
+	AddMount     *bool    `yaml:"addMount"`
+	Docker       *bool    `yaml:"docker"`
+	AddDocker    *bool    `yaml:"addDocker"`
+	DockerSocket string   `yaml:"dockerSocket"`
+	Runtime      string   `yaml:"runtime"`
+	Rebuild      *bool    `yaml:"rebuild"`
+	Root         *bool    `yaml:"root"`
+	Tty          *bool    `yaml:"tty"`
+	SSH          *bool    `yaml:"ssh"`
+	CmdProxy     *bool    `yaml:"cmdProxy"`
+	CmdProxyPort string   `yaml:"cmdProxyPort"`
+	// CmdProxyAllow is the allowlist of commands the command proxy can run
+	CmdProxyAllow  []proxyRule `yaml:"cmdProxyAllow"`
+	CmdProxyEnv    []string    `yaml:"cmdProxyEnv"`
+	CmdProxySocket *bool       `yaml:"cmdProxySocket"`
+	Proxy          []string    `yaml:"proxy"`
+	CmdProxyLog    string      `yaml:"cmdProxyLog"`
+	CmdProxyRedact []string    `yaml:"cmdProxyRedact"`
+	Stages         []stage     `yaml:"stages"`
+
+	// Limits of the command proxy. CmdProxyTimeout is a duration like 10m.
+	CmdProxyMaxCommands *int          `yaml:"cmdProxyMaxCommands"`
+	CmdProxyTimeout     time.Duration `yaml:"cmdProxyTimeout"`
+	CmdProxyMaxOutput   int64         `yaml:"cmdProxyMaxOutput"`
+	CmdProxyDirs        []string      `yaml:"cmdProxyDirs"`
+
+	// SSHKeys are the keys of the agent that are forwarded
+	SSHKeys    []string `yaml:"sshKeys"`
+	SSHConfirm *bool    `yaml:"sshConfirm"`
+	GPG        *bool    `yaml:"gpg"`
+	// SSHTimeout is a duration like 30s
+	SSHTimeout time.Duration `yaml:"sshTimeout"`
+
+	// EnvFiles are dotenv files, relative to the config file
+	EnvFiles []string `yaml:"envFiles"`
+
+	// path is the location the file was loaded from
+	path string
+}
+
+// findConfigFile looks for a .lope.yml file in dir and each of its parents.
+// The search stops at the root of the git repository that dir is part of so
+// that a config file outside of the project is never picked up by accident.
+func findConfigFile(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		file := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(file); err == nil {
+			return file, true
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", false
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+func loadConfigFile(file string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileConfig{}
+	if err := yaml.UnmarshalStrict(b, fc); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", file, err)
+	}
+	fc.path = file
+	return fc, nil
+}
+
+// apply copies the values from the config file into c. Any setting that was
+// explicitly passed as a command line flag is left alone so that flags always
+// take precedence over the file.
+func (f *fileConfig) apply(c *config, set map[string]bool) {
+	if f.Image != "" {
+		c.sourceImage = os.ExpandEnv(f.Image)
+	}
+	if f.Command != "" {
+		c.cmd = []string{f.Command}
+	}
+	if f.Entrypoint != "" && !set["entrypoint"] {
+		c.entrypoint = f.Entrypoint
+	}
+	if f.Dir != "" && !set["dir"] {
+		c.dir = f.resolvePath(f.Dir)
+	}
+	if f.WorkDir != "" && !set["workDir"] {
+		c.workDir = f.WorkDir
+	}
+	if len(f.Env) > 0 && !set["whitelist"] {
+		c.whitelist = f.Env
+	}
+	if len(f.Blacklist) > 0 && !set["blacklist"] {
+		c.blacklist = f.Blacklist
+	}
+	if len(f.Instructions) > 0 && !set["instruction"] {
+		c.instructions = f.Instructions
+	}
+	if f.Context != "" && !set["context"] {
+		c.context = f.Context
+	}
+	if len(f.Ignore) > 0 {
+		c.ignore = f.Ignore
+	}
+	if len(f.Paths) > 0 && !set["path"] {
+		c.paths = []string{}
+		for _, p := range f.Paths {
+			c.paths = append(c.paths, path(p))
+		}
+	}
+	if len(f.Args) > 0 && !set["arg"] {
+		extraArgs = f.Args
+	}
+	if f.Mount != nil && !set["noMount"] {
+		c.mount = *f.Mount
+	}
+	if f.AddMount != nil && !set["addMount"] {
+		c.addMount = *f.AddMount
+	}
+	if c.addMount {
+		c.mount = false
+	}
+	if f.Docker != nil && !set["noDocker"] {
+		c.docker = *f.Docker
+	}
+	if f.AddDocker != nil && !set["addDocker"] {
+		c.addDocker = *f.AddDocker
+	}
+	if f.DockerSocket != "" && !set["dockerSocket"] {
+		c.dockerSocket = f.DockerSocket
+	}
+	if f.Runtime != "" && !set["runtime"] {
+		c.runtimeName = f.Runtime
+	}
+	if f.Rebuild != nil && !set["rebuild"] {
+		c.rebuild = *f.Rebuild
+	}
+	if f.Root != nil && !set["noRoot"] {
+		c.root = *f.Root
+	}
+	if f.Tty != nil && !set["noTty"] {
+		c.tty = *f.Tty
+	}
+	if f.SSH != nil && !set["ssh"] {
+		c.ssh = *f.SSH
+	}
+	if f.CmdProxy != nil && !set["cmdProxy"] {
+		c.cmdProxy = *f.CmdProxy
+	}
+	if f.CmdProxyPort != "" && !set["cmdProxyPort"] {
+		c.cmdProxyPort = f.CmdProxyPort
+	}
+	if len(f.CmdProxyAllow) > 0 && !set["cmdProxyAllow"] {
+		c.cmdProxyAllow = f.CmdProxyAllow
+	}
+	if f.CmdProxySocket != nil && !set["cmdProxySocket"] {
+		c.cmdProxySocket = *f.CmdProxySocket
+	}
+	if f.CmdProxyLog != "" && !set["cmdProxyLog"] {
+		c.cmdProxyLog = f.resolvePath(f.CmdProxyLog)
+	}
+	if len(f.CmdProxyRedact) > 0 && !set["cmdProxyRedact"] {
+		c.cmdProxyRedact = f.CmdProxyRedact
+	}
+	if f.CmdProxyMaxCommands != nil && !set["cmdProxyMaxCommands"] {
+		c.cmdProxyMaxCommands = *f.CmdProxyMaxCommands
+	}
+	if f.CmdProxyTimeout != 0 && !set["cmdProxyTimeout"] {
+		c.cmdProxyTimeout = f.CmdProxyTimeout
+	}
+	if f.CmdProxyMaxOutput != 0 && !set["cmdProxyMaxOutput"] {
+		c.cmdProxyMaxOutput = f.CmdProxyMaxOutput
+	}
+	if len(f.SSHKeys) > 0 && !set["sshKey"] {
+		c.sshKeys = f.SSHKeys
+	}
+	if f.SSHConfirm != nil && !set["sshConfirm"] {
+		c.sshConfirm = *f.SSHConfirm
+	}
+	if f.SSHTimeout != 0 && !set["sshTimeout"] {
+		c.sshTimeout = f.SSHTimeout
+	}
+	if f.GPG != nil && !set["gpg"] {
+		c.gpg = *f.GPG
+	}
+	if len(f.CmdProxyDirs) > 0 && !set["cmdProxyDir"] {
+		c.cmdProxyDirs = nil
+		for _, d := range f.CmdProxyDirs {
+			// The path of name=path is relative to the config file too
+			parts := strings.SplitN(d, "=", 2)
+			parts[len(parts)-1] = f.resolvePath(parts[len(parts)-1])
+			c.cmdProxyDirs = append(c.cmdProxyDirs, strings.Join(parts, "="))
+		}
+	}
+	if len(f.EnvFiles) > 0 && !set["envFile"] {
+		c.envFiles = nil
+		for _, e := range f.EnvFiles {
+			c.envFiles = append(c.envFiles, f.resolvePath(e))
+		}
+	}
+	if len(f.Proxy) > 0 && !set["proxy"] {
+		c.proxyCommands = f.Proxy
+	}
+	if len(f.CmdProxyEnv) > 0 && !set["cmdProxyEnv"] {
+		c.cmdProxyEnv = f.CmdProxyEnv
+	}
+}
+
+// resolvePath expands environment variables in a path of the config file and
+// makes relative paths relative to the location of the file
+func (f *fileConfig) resolvePath(p string) string {
+	p = os.ExpandEnv(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(f.path), p)
+	}
+	return p
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindConfigFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "lope-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	repo := filepath.Join(root, "repo")
+	sub := filepath.Join(repo, "sub", "dir")
+	os.MkdirAll(sub, 0755)
+	os.MkdirAll(filepath.Join(repo, ".git"), 0755)
+
+	// A config file above the repository root should never be found
+	ioutil.WriteFile(filepath.Join(root, configFileName), []byte(""), 0644)
+
+	if file, ok := findConfigFile(sub); ok {
+		t.Errorf("found %q outside of the repository", file)
+	}
+
+	want := filepath.Join(repo, configFileName)
+	ioutil.WriteFile(want, []byte(""), 0644)
+
+	var tests = []struct {
+		description string
+		dir         string
+	}{
+		{
+			"Find the config file in the current directory",
+			repo,
+		},
+		{
+			"Find the config file in a parent directory",
+			sub,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := findConfigFile(test.dir)
+			if !ok || got != want {
+				t.Errorf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, configFileName)
+	ioutil.WriteFile(file, []byte("image: alpine\ncommand: ls -lhatr\nenv:\n  - ^AWS\nssh: true\n"), 0644)
+
+	got, err := loadConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Image != "alpine" || got.Command != "ls -lhatr" || !reflect.DeepEqual(got.Env, []string{"^AWS"}) || !*got.SSH {
+		t.Errorf("unexpected config %+v", got)
+	}
+
+	ioutil.WriteFile(file, []byte("imgae: alpine\n"), 0644)
+	if _, err := loadConfigFile(file); err == nil {
+		t.Errorf("expected an error for an unknown key")
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	yes := true
+
+	var tests = []struct {
+		description string
+		file        *fileConfig
+		set         map[string]bool
+		want        config
+	}{
+		{
+			"Values from the file are used when no flags are set",
+			&fileConfig{
+				Image:    "alpine",
+				Command:  "ls -lhatr",
+				WorkDir:  "/app",
+				Env:      []string{"^AWS"},
+				AddMount: &yes,
+				path:     "/project/.lope.yml",
+			},
+			map[string]bool{},
+			config{
+				sourceImage: "alpine",
+				cmd:         []string{"ls -lhatr"},
+				workDir:     "/app",
+				whitelist:   []string{"^AWS"},
+				addMount:    true,
+				mount:       false,
+			},
+		},
+		{
+			"Flags take precedence over the file",
+			&fileConfig{
+				WorkDir:  "/app",
+				AddMount: &yes,
+				path:     "/project/.lope.yml",
+			},
+			map[string]bool{"workDir": true, "addMount": true},
+			config{
+				workDir: "/lope",
+				mount:   true,
+			},
+		},
+		{
+			"Relative directories are resolved from the config file location",
+			&fileConfig{
+				Dir:  "src",
+				path: filepath.FromSlash("/project/.lope.yml"),
+			},
+			map[string]bool{},
+			config{
+				dir:     filepath.FromSlash("/project/src"),
+				workDir: "/lope",
+				mount:   true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := config{
+				workDir: "/lope",
+				mount:   true,
+			}
+			test.file.apply(&got, test.set)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultIgnore is always left out of the build context. Patterns in a
+// .dockerignore file or the config file can add these back in with !.
+var defaultIgnore = []string{
+	".git",
+	".vagrant",
+	"node_modules",
+}
+
+// ignorePattern is a single line of a .dockerignore file
+type ignorePattern struct {
+	re      *regexp.Regexp
+	exclude bool
+}
+
+// ignoreMatcher decides which files are left out of a build context using the
+// same rules as .dockerignore files. Later patterns take precedence and
+// patterns starting with ! add files back in.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+func newIgnoreMatcher(lines []string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exclude := false
+		if strings.HasPrefix(line, "!") {
+			exclude = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		re, err := regexp.Compile(patternRegexp(line))
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, ignorePattern{re: re, exclude: exclude})
+	}
+	return m, nil
+}
+
+// patternRegexp converts a .dockerignore pattern into a regular expression.
+// * and ? never match a separator while ** matches any number of directories.
+func patternRegexp(pattern string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				i++
+				re.WriteString("(.*/)?")
+			} else {
+				re.WriteString(".*")
+			}
+		case ch == '*':
+			re.WriteString("[^/]*")
+		case ch == '?':
+			re.WriteString("[^/]")
+		case ch == '[':
+			class, n := patternClass(pattern[i:])
+			if n == 0 {
+				re.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			re.WriteString(class)
+			i += n - 1
+		case ch == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// patternClass converts the character class at the start of pattern, like
+// [a-z] or the negated [!a], into a regex. It returns the regex and the length
+// of the class in the pattern, which is 0 when the class isn't closed.
+func patternClass(pattern string) (string, int) {
+	var class strings.Builder
+	class.WriteString("[")
+	i := 1
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		// Like * and ? a negated class never matches a separator
+		class.WriteString("^/")
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == ']':
+			class.WriteString("]")
+			return class.String(), i + 1
+		case ch == '\\' && i+1 < len(pattern):
+			// Escaped characters are taken literally, even a - or ]
+			i++
+			if pattern[i] == '-' {
+				class.WriteString(`\-`)
+			} else {
+				class.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		case ch == '-':
+			class.WriteString("-")
+		default:
+			class.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return "", 0
+}
+
+// ignored reports if a slash separated path relative to the context root
+// should be left out. A path is also ignored when one of its parents is.
+func (m *ignoreMatcher) ignored(rel string) bool {
+	parents := []string{}
+	for p := rel; p != "."; p = filepath.ToSlash(filepath.Dir(p)) {
+		parents = append(parents, p)
+		if !strings.Contains(p, "/") {
+			break
+		}
+	}
+
+	ignored := false
+	for _, p := range m.patterns {
+		for _, parent := range parents {
+			if p.re.MatchString(parent) {
+				ignored = !p.exclude
+				break
+			}
+		}
+	}
+	return ignored
+}
+
+// hasExclusions reports if any pattern can add files back in. When there are
+// none ignored directories can be skipped entirely.
+func (m *ignoreMatcher) hasExclusions() bool {
+	for _, p := range m.patterns {
+		if p.exclude {
+			return true
+		}
+	}
+	return false
+}
+
+func readIgnoreFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// contextIgnore merges the default ignore list with the .dockerignore file in
+// dir and the extra patterns from the config, in that order of precedence
+func contextIgnore(dir string, extra []string) (*ignoreMatcher, error) {
+	lines, err := readIgnoreFile(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		return nil, err
+	}
+	patterns := append([]string{}, defaultIgnore...)
+	patterns = append(patterns, lines...)
+	patterns = append(patterns, extra...)
+	return newIgnoreMatcher(patterns)
+}
+
+// buildContext describes which files are sent to the docker daemon when an
+// image is built
+type buildContext struct {
+	dir    string
+	ignore []string
+	// source is either "dir" for every file in dir, "git" for the files that
+	// are tracked by git or "git-untracked" to also include untracked files
+	// which aren't ignored by git
+	source string
+}
+
+// walk calls fn for every file in the build context that isn't ignored. rel is
+// the slash separated path relative to dir.
+func (b *buildContext) walk(fn func(file string, rel string, info os.FileInfo) error) error {
+	m, err := contextIgnore(b.dir, b.ignore)
+	if err != nil {
+		return err
+	}
+
+	switch b.source {
+	case "", "dir":
+		return walkDir(b.dir, m, fn)
+	case "git", "git-untracked":
+		return walkGit(b.dir, m, b.source == "git-untracked", fn)
+	}
+	return fmt.Errorf("unknown build context %q, must be one of dir, git or git-untracked", b.source)
+}
+
+func walkDir(dir string, m *ignoreMatcher, fn func(file string, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if m.ignored(rel) {
+			if info.IsDir() && !m.hasExclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(file, rel, info)
+	})
+}
+
+// walkGit only visits the files that git knows about so that files which are
+// ignored by git, like local secrets and build output, never end up in an image
+func walkGit(dir string, m *ignoreMatcher, untracked bool, fn func(file string, rel string, info os.FileInfo) error) error {
+	args := []string{"git", "-C", dir, "ls-files", "-z", "--cached"}
+	if untracked {
+		args = append(args, "--others", "--exclude-standard")
+	}
+	// Warnings on stderr must not end up in the list of files
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the files tracked by git in %q: %v %v", dir, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Sort the files so that the hash of the context is stable
+	files := strings.Split(string(out), "\x00")
+	sort.Strings(files)
+
+	seen := make(map[string]bool)
+	for _, rel := range files {
+		if rel == "" || seen[rel] || m.ignored(rel) {
+			continue
+		}
+		seen[rel] = true
+
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Lstat(file)
+		// Files that are deleted but not committed yet are still listed
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Submodules are listed as a single directory entry
+		if info.IsDir() {
+			continue
+		}
+		if err := fn(file, rel, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hash returns a digest of the names, modes and contents of the files in the
+// build context. Modification times are left out so that a fresh checkout of
+// the same files doesn't cause a rebuild.
+func (b *buildContext) hash() (string, error) {
+	h := sha256.New()
+	err := b.walk(func(file string, rel string, info os.FileInfo) error {
+		fmt.Fprintf(h, "%v %v\n", rel, info.Mode())
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(h, link)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// archive streams a tar archive of the build context to send to the docker
+// daemon, with the generated dockerfile added as name. Building the archive in
+// lope means the ignore list can be applied without touching the .dockerignore
+// file in the users directory. Errors are returned when reading the archive.
+func (b *buildContext) archive(name string, dockerfile string) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := b.walk(func(file string, rel string, info os.FileInfo) error {
+			return addToArchive(tw, file, rel, info)
+		})
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(dockerfile)),
+				Typeflag: tar.TypeReg,
+			})
+		}
+		if err == nil {
+			_, err = tw.Write([]byte(dockerfile))
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func addToArchive(tw *tar.Writer, file string, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	h, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.IsDir() {
+		h.Name += "/"
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		patterns    []string
+		path        string
+		want        bool
+	}{
+		{
+			"Ignore a directory and everything in it",
+			[]string{".git"},
+			".git/config",
+			true,
+		},
+		{
+			"Wildcards don't match separators",
+			[]string{"*.md"},
+			"docs/README.md",
+			false,
+		},
+		{
+			"Double wildcards match any directory",
+			[]string{"**/*.md"},
+			"docs/README.md",
+			true,
+		},
+		{
+			"Exclusions add files back in",
+			[]string{"*.md", "!README.md"},
+			"README.md",
+			false,
+		},
+		{
+			"Comments are ignored",
+			[]string{"# lope.go"},
+			"lope.go",
+			false,
+		},
+		{
+			"Character classes match one of the characters",
+			[]string{"[a-c]bc"},
+			"abc",
+			true,
+		},
+		{
+			"Negated character classes don't match the characters",
+			[]string{"[!a]bc"},
+			"abc",
+			false,
+		},
+		{
+			"Negated character classes match any other character",
+			[]string{"[!a]bc"},
+			"xbc",
+			true,
+		},
+		{
+			"Negated character classes don't match a separator",
+			[]string{"a[!b]c"},
+			"a/c",
+			false,
+		},
+		{
+			"Escaped wildcards are matched literally",
+			[]string{`file\*`},
+			"file*",
+			true,
+		},
+		{
+			"Escaped wildcards don't match anything else",
+			[]string{`file\*`},
+			"files",
+			false,
+		},
+		{
+			"Escaped characters in classes are matched literally",
+			[]string{`a[\]x]c`},
+			"a]c",
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			m, err := newIgnoreMatcher(test.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.ignored(test.path)
+			if got != test.want {
+				t.Errorf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContextHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.go")
+	ioutil.WriteFile(file, []byte("package main"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0644)
+
+	hash := func() string {
+		b := &buildContext{dir: dir}
+		h, err := b.hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	first := hash()
+
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Hour))
+	if hash() != first {
+		t.Errorf("expected the hash to ignore modification times")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "build.log"), []byte("ignored"), 0644)
+	if hash() != first {
+		t.Errorf("expected the hash to ignore files in .dockerignore")
+	}
+
+	ioutil.WriteFile(file, []byte("package lope"), 0644)
+	if hash() == first {
+		t.Errorf("expected the hash to change with the contents")
+	}
+}
+
+func TestContextIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n!node_modules\n"), 0644)
+
+	var tests = []struct {
+		description string
+		extra       []string
+		path        string
+		want        bool
+	}{
+		{
+			"The .git directory is ignored by default",
+			[]string{},
+			".git/HEAD",
+			true,
+		},
+		{
+			"Patterns from .dockerignore are used",
+			[]string{},
+			"build.log",
+			true,
+		},
+		{
+			"The .dockerignore file can add defaults back in",
+			[]string{},
+			"node_modules/left-pad/index.js",
+			false,
+		},
+		{
+			"Patterns from the config file take precedence",
+			[]string{"node_modules", "!debug.log"},
+			"node_modules/left-pad/index.js",
+			true,
+		},
+		{
+			"Exclusions from the config file take precedence",
+			[]string{"node_modules", "!debug.log"},
+			"debug.log",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			m, err := contextIgnore(dir, test.extra)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := m.ignored(test.path)
+			if got != test.want {
+				t.Errorf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGitContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if out, err := run([]string{"git", "init", dir}, false); err != nil {
+		t.Skipf("git is not available: %v %v", err, out)
+	}
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte(".env\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "new.go"), []byte("package main"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=hunter2"), 0644)
+	run([]string{"git", "-C", dir, "add", ".gitignore", "main.go"}, false)
+
+	var tests = []struct {
+		description string
+		source      string
+		want        []string
+	}{
+		{
+			"Only tracked files are in the git context",
+			"git",
+			[]string{".gitignore", "main.go"},
+		},
+		{
+			"Untracked files which aren't ignored can be included",
+			"git-untracked",
+			[]string{".gitignore", "main.go", "new.go"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			b := &buildContext{dir: dir, source: test.source}
+			got := []string{}
+			err := b.walk(func(file string, rel string, info os.FileInfo) error {
+				got = append(got, rel)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+	empty, err := ioutil.TempDir("", "lope-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	b := &buildContext{dir: empty, source: "git"}
+	err = b.walk(func(file string, rel string, info os.FileInfo) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "not a git repository") {
+		t.Errorf("got error %v want the error git printed", err)
+	}
+}
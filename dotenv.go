@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envName is a variable name that works in any shell
+var envName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// loadEnvFiles reads dotenv files in order, so that later files override the
+// values of earlier ones. It returns NAME=value pairs.
+func loadEnvFiles(files []string) ([]string, error) {
+	values := make(map[string]string)
+	order := []string{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		lookup := func(name string) (string, bool) {
+			if v, ok := values[name]; ok {
+				return v, true
+			}
+			return os.LookupEnv(name)
+		}
+		err = parseDotenv(f, lookup, func(name string, value string) {
+			if _, ok := values[name]; !ok {
+				order = append(order, name)
+			}
+			values[name] = value
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+	}
+
+	env := []string{}
+	for _, name := range order {
+		env = append(env, name+"="+values[name])
+	}
+	return env, nil
+}
+
+// parseDotenv parses a dotenv file and calls set for every variable. Lines
+// look like NAME=value and can start with export. Single quoted values are
+// taken literally. Double quoted values can span lines and contain escapes
+// like \n. Variables like $NAME or ${NAME} in unquoted and double quoted
+// values are replaced with the value from lookup.
+func parseDotenv(r io.Reader, lookup func(string) (string, bool), set func(string, string)) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimSpace(strings.TrimPrefix(text, "export "))
+
+		parts := strings.SplitN(text, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !envName.MatchString(name) {
+			return fmt.Errorf("line %d: expected NAME=value, got %q", line, text)
+		}
+		raw := strings.TrimSpace(parts[1])
+
+		var value string
+		switch {
+		case strings.HasPrefix(raw, "'"):
+			end := strings.Index(raw[1:], "'")
+			if end == -1 {
+				return fmt.Errorf("line %d: missing closing ' for %v", line, name)
+			}
+			value = raw[1 : end+1]
+		case strings.HasPrefix(raw, `"`):
+			start := line
+			quoted := raw[1:]
+			for !closed(quoted) {
+				if !scanner.Scan() {
+					return fmt.Errorf("line %d: missing closing \" for %v", start, name)
+				}
+				line++
+				quoted += "\n" + scanner.Text()
+			}
+			value = expand(unescape(quoted[:closing(quoted)]), lookup)
+		default:
+			// Comments after unquoted values need a space before the #
+			if i := strings.Index(raw, " #"); i != -1 {
+				raw = strings.TrimSpace(raw[:i])
+			}
+			value = expand(raw, lookup)
+		}
+		set(name, value)
+	}
+	return scanner.Err()
+}
+
+// closing returns the index of the first unescaped double quote or -1
+func closing(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func closed(s string) bool {
+	return closing(s) != -1
+}
+
+var escapes = strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`, `\$`, "\x00")
+
+// unescape replaces the escapes of double quoted values. Escaped dollar signs
+// are kept as a placeholder until the variables are expanded.
+func unescape(s string) string {
+	return escapes.Replace(s)
+}
+
+// expand replaces $NAME and ${NAME} with the value from lookup. Unknown
+// variables are empty like in a shell.
+func expand(s string, lookup func(string) (string, bool)) string {
+	expanded := os.Expand(s, func(name string) string {
+		v, _ := lookup(name)
+		return v
+	})
+	return strings.Replace(expanded, "\x00", "$", -1)
+}
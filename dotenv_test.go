@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	host := map[string]string{"HOST": "host", "USER": "lope"}
+	lookup := func(name string) (string, bool) {
+		v, ok := host[name]
+		return v, ok
+	}
+
+	var tests = []struct {
+		description string
+		file        string
+		want        []string
+		err         string
+	}{
+		{
+			"Comments and empty lines are ignored",
+			"# comment\n\nA=1\n",
+			[]string{"A=1"},
+			"",
+		},
+		{
+			"Export is allowed",
+			"export A=1",
+			[]string{"A=1"},
+			"",
+		},
+		{
+			"Unquoted values are trimmed and can have comments",
+			"A = hello world # comment\nB=a#b",
+			[]string{"A=hello world", "B=a#b"},
+			"",
+		},
+		{
+			"Variables are interpolated from the host",
+			"A=$HOST-${USER}-$MISSING",
+			[]string{"A=host-lope-"},
+			"",
+		},
+		{
+			"Single quoted values are taken literally",
+			`A='$HOST\n # not a comment'`,
+			[]string{`A=$HOST\n # not a comment`},
+			"",
+		},
+		{
+			"Double quoted values have escapes and variables",
+			`A="say \"hi\"\n$HOST \$HOST"`,
+			[]string{"A=say \"hi\"\nhost $HOST"},
+			"",
+		},
+		{
+			"Double quoted values can span lines",
+			"A=\"line1\nline2\"\nB=2",
+			[]string{"A=line1\nline2", "B=2"},
+			"",
+		},
+		{
+			"Empty values are allowed",
+			"A=\nB=''",
+			[]string{"A=", "B="},
+			"",
+		},
+		{
+			"Lines without a value are an error",
+			"A=1\nB",
+			nil,
+			"line 2: expected NAME=value",
+		},
+		{
+			"Invalid names are an error",
+			"1A=1",
+			nil,
+			"line 1: expected NAME=value",
+		},
+		{
+			"Unclosed quotes are an error",
+			"A=1\nB=\"open\nC=3",
+			nil,
+			"line 2: missing closing \" for B",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var got []string
+			err := parseDotenv(strings.NewReader(test.file), lookup, func(name string, value string) {
+				got = append(got, name+"="+value)
+			})
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "first.env")
+	second := filepath.Join(dir, "second.env")
+	ioutil.WriteFile(first, []byte("A=1\nB=2\n"), 0600)
+	ioutil.WriteFile(second, []byte("B=${A}${B}\nC=3\n"), 0600)
+
+	got, err := loadEnvFiles([]string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"A=1", "B=12", "C=3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	ioutil.WriteFile(second, []byte("invalid\n"), 0600)
+	_, err = loadEnvFiles([]string{first, second})
+	if err == nil || !strings.Contains(err.Error(), second+": line 1") {
+		t.Errorf("got error %v want the file and line of the error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes for failures of lope itself. The command in the container can
+// exit with any status so lope uses a range that is rarely used by commands,
+// above the 128+n statuses of commands that were killed by a signal.
+const (
+	exitLope    = 200 // lope failed for any other reason
+	exitConfig  = 201 // invalid flags, config file or stages
+	exitRuntime = 202 // the container runtime is not installed or unreachable
+	exitBuild   = 203 // building the image failed
+)
+
+// exitError is an error that makes lope exit with a specific status
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.Err
+}
+
+// cliFailed is the status docker, podman and nerdctl exit with when they fail
+// themselves, for example when the daemon can't be reached or an image can't
+// be pulled, rather than the container exiting with it
+const cliFailed = 125
+
+// commandExit converts the error of a CLI command that ran the container
+// attached into a runtimeError with the exit status of the container
+func commandExit(err error) error {
+	if _, ok := err.(*exec.ExitError); !ok {
+		return err
+	}
+	status := commandStatus(err)
+	return &runtimeError{
+		Action:  "run",
+		Status:  status,
+		Message: fmt.Sprintf("container exited with status %d", status),
+	}
+}
+
+// commandStatus returns the exit status of a command the way a shell reports
+// it. Commands that couldn't be started exit with 127.
+func commandStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 127
+	}
+	// The command was killed by a signal
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// containerExit returns the exit status of the container command if err was
+// caused by the command failing rather than by lope
+func containerExit(err error) (int, bool) {
+	var e *runtimeError
+	if errors.As(err, &e) && e.Action == "run" && e.Status > 0 {
+		return e.Status, true
+	}
+	return 0, false
+}
+
+// exitCode returns the status lope exits with after err. This is the exit
+// status of the container command or one of the reserved exit codes.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if status, ok := containerExit(err); ok {
+		return status
+	}
+
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+
+	var e *runtimeError
+	if errors.As(err, &e) {
+		// The CLI couldn't be started or the daemon couldn't be reached
+		if e.Status == -1 {
+			return exitRuntime
+		}
+		if e.Action == "build" {
+			return exitBuild
+		}
+	}
+	return exitLope
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	var tests = []struct {
+		description string
+		err         error
+		want        int
+	}{
+		{
+			"Success exits with 0",
+			nil,
+			0,
+		},
+		{
+			"The exit status of the container is passed through",
+			&runtimeError{Action: "run", Status: 2},
+			2,
+		},
+		{
+			"Containers killed by a signal keep their status",
+			&runtimeError{Action: "run", Status: 137},
+			137,
+		},
+		{
+			"The exit status of a failed stage is passed through",
+			fmt.Errorf("stage %q failed: %w", "test", &runtimeError{Action: "run", Status: 3}),
+			3,
+		},
+		{
+			"Build failures have their own exit code",
+			&runtimeError{Action: "build", Status: 1},
+			exitBuild,
+		},
+		{
+			"An unreachable runtime has its own exit code",
+			&runtimeError{Action: "build", Status: -1},
+			exitRuntime,
+		},
+		{
+			"Failing to attach to the container is not the exit status of the container",
+			&runtimeError{Action: "attach", Status: 500},
+			exitLope,
+		},
+		{
+			"Errors can set their exit code",
+			fmt.Errorf("wrapped: %w", &exitError{Code: exitConfig, Err: errors.New("unknown stage")}),
+			exitConfig,
+		},
+		{
+			"Any other error is a failure of lope",
+			errors.New("failed to copy artifact"),
+			exitLope,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := exitCode(test.err)
+
+			if got != test.want {
+				t.Errorf("got %d want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCLIExit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+
+	var tests = []struct {
+		description string
+		status      string
+		want        int
+	}{
+		{
+			"The exit status of the container is passed through",
+			"3",
+			3,
+		},
+		{
+			"Failures of the CLI itself are runtime failures",
+			"125",
+			exitRuntime,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := (&cliRuntime{binary: "sh"}).attach([]string{"-c", "exit " + test.status}, nil)
+			got := exitCode(err)
+
+			if got != test.want {
+				t.Errorf("got %d want %d", got, test.want)
+			}
+		})
+	}
+}
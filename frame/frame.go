@@ -0,0 +1,162 @@
+// Package frame implements the framing used by the lope command proxy to send
+// the input and output of a command, terminal size changes, signals and the
+// exit status over a single connection.
+//
+// Every frame starts with an 8 byte header. The first byte is the type of the
+// frame, followed by 3 reserved bytes and the length of the payload as a big
+// endian uint32, the same layout docker uses for attached streams.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Types of frames
+const (
+	// Stdin is sent by the client. An empty Stdin frame closes stdin.
+	Stdin  byte = 0
+	Stdout byte = 1
+	Stderr byte = 2
+	// Exit is the last frame and carries the exit status as a big endian int32
+	Exit byte = 3
+	// Resize is sent by the client when the size of its terminal changes
+	Resize byte = 4
+	// Signal is sent by the client with the name of a signal, like SIGINT
+	Signal byte = 5
+)
+
+// Upgrade is the protocol a client asks for to send frames in both
+// directions over a hijacked HTTP connection
+const Upgrade = "lope-frames"
+
+// ContentType is the content type of a response that is a stream of frames
+const ContentType = "application/vnd.lope.frames"
+
+// maxSize protects readers from allocating huge buffers for corrupt headers
+const maxSize = 1 << 20
+
+// Write writes a single frame
+func Write(w io.Writer, kind byte, payload []byte) error {
+	header := make([]byte, 8)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Read reads the next frame. io.EOF is returned when there are no more frames.
+func Read(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > maxSize {
+		return 0, nil, errors.New("frame is too large")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// ExitStatus encodes an exit status as the payload of an Exit frame
+func ExitStatus(status int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(status)))
+	return b
+}
+
+// ParseExitStatus decodes the payload of an Exit frame
+func ParseExitStatus(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, errors.New("invalid exit frame")
+	}
+	return int(int32(binary.BigEndian.Uint32(payload))), nil
+}
+
+// Size encodes the rows and columns of a terminal as the payload of a Resize
+// frame
+func Size(rows uint16, cols uint16) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, rows)
+	binary.BigEndian.PutUint16(b[2:], cols)
+	return b
+}
+
+// ParseSize decodes the payload of a Resize frame
+func ParseSize(payload []byte) (uint16, uint16, error) {
+	if len(payload) != 4 {
+		return 0, 0, errors.New("invalid resize frame")
+	}
+	return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), nil
+}
+
+// Writer is shared by the streams of a command so that frames of different
+// types are never interleaved. Every frame is flushed straight away so that
+// output arrives in real time.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	flush  func()
+	output int64
+}
+
+// NewWriter returns a Writer for w. flush is called after every frame and can
+// be nil.
+func NewWriter(w io.Writer, flush func()) *Writer {
+	return &Writer{w: w, flush: flush}
+}
+
+// Frame writes a single frame
+func (f *Writer) Frame(kind byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := Write(f.w, kind, payload); err != nil {
+		return err
+	}
+	if kind == Stdout || kind == Stderr {
+		f.output += int64(len(payload))
+	}
+	if f.flush != nil {
+		f.flush()
+	}
+	return nil
+}
+
+// Output returns the number of bytes sent in Stdout and Stderr frames
+func (f *Writer) Output() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.output
+}
+
+// Stream returns an io.Writer that writes everything as frames of kind
+func (f *Writer) Stream(kind byte) io.Writer {
+	return &stream{f: f, kind: kind}
+}
+
+type stream struct {
+	f    *Writer
+	kind byte
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	if len(p) > maxSize {
+		p = p[:maxSize]
+	}
+	if err := s.f.Frame(s.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,102 @@
+package frame
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil)
+	io.WriteString(w.Stream(Stdout), "out")
+	io.WriteString(w.Stream(Stderr), "err")
+	w.Frame(Exit, ExitStatus(2))
+
+	if got := w.Output(); got != 6 {
+		t.Errorf("got %d bytes of output want %d", got, 6)
+	}
+
+	var tests = []struct {
+		description string
+		kind        byte
+		payload     string
+	}{
+		{
+			"Stdout is sent in its own frame",
+			Stdout,
+			"out",
+		},
+		{
+			"Stderr is sent in its own frame",
+			Stderr,
+			"err",
+		},
+		{
+			"The exit status is sent last",
+			Exit,
+			string(ExitStatus(2)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			kind, payload, err := Read(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != test.kind {
+				t.Errorf("got %d want %d", kind, test.kind)
+			}
+			if string(payload) != test.payload {
+				t.Errorf("got %q want %q", payload, test.payload)
+			}
+		})
+	}
+
+	if _, _, err := Read(&buf); err != io.EOF {
+		t.Errorf("got %v want %v", err, io.EOF)
+	}
+}
+
+func TestParseExitStatus(t *testing.T) {
+	var tests = []struct {
+		description string
+		status      int
+	}{
+		{
+			"Success",
+			0,
+		},
+		{
+			"Killed by a signal",
+			137,
+		},
+		{
+			"Negative statuses survive",
+			-1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseExitStatus(ExitStatus(test.status))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.status {
+				t.Errorf("got %d want %d", got, test.status)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	rows, cols, err := ParseSize(Size(24, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 24 || cols != 80 {
+		t.Errorf("got %dx%d want %dx%d", rows, cols, 24, 80)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/Crazybus/lope
+
+go 1.26.0
+
+require (
+	github.com/creack/pty v1.1.24
+	golang.org/x/crypto v0.57.0
+	golang.org/x/term v0.46.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
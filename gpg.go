@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gpgHome is the GNUPGHOME of the container. The extra socket of the agent of
+// the host is mounted where gpg looks for its agent.
+const gpgHome = "/root/.gnupg"
+
+// gpgPublicFiles are copied from the GNUPGHOME of the host so that gpg in the
+// container knows the public keys and their trust. The private keys stay in
+// the agent.
+var gpgPublicFiles = []string{"pubring.kbx", "pubring.gpg", "trustdb.gpg"}
+
+// gpgForward makes the gpg agent of the host available in the container. The
+// extra socket of the agent is meant for forwarding, it can sign and decrypt
+// but can't export or change any keys.
+func (l *lope) gpgForward() error {
+	if !l.cfg.gpg {
+		return nil
+	}
+
+	// Forwarding only works when the agent is running
+	if out, err := run([]string{"gpgconf", "--launch", "gpg-agent"}, false); err != nil {
+		return fmt.Errorf("failed to start the agent, is gpg installed? %v %v", err, strings.TrimSpace(out))
+	}
+	out, err := run([]string{"gpgconf", "--list-dirs"}, false)
+	if err != nil {
+		return fmt.Errorf("failed to find the socket of the agent: %v %v", err, strings.TrimSpace(out))
+	}
+	dirs := parseGPGDirs(out)
+	return l.forwardGPG(dirs["agent-extra-socket"], dirs["homedir"])
+}
+
+// forwardGPG creates the GNUPGHOME for the container with the public keyring
+// of home and mounts socket as its agent
+func (l *lope) forwardGPG(socket string, home string) error {
+	if socket == "" || home == "" {
+		return fmt.Errorf("gpgconf didn't return the extra socket of the agent")
+	}
+
+	dir, err := ioutil.TempDir("", "lope-gnupg")
+	if err != nil {
+		return err
+	}
+	l.addCleanup(func() {
+		os.RemoveAll(dir)
+	})
+	for _, name := range gpgPublicFiles {
+		err := copyFile(filepath.Join(home, name), filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// gpg in the container must not start an agent of its own without keys
+	if err := ioutil.WriteFile(filepath.Join(dir, "gpg.conf"), []byte("no-autostart\n"), 0600); err != nil {
+		return err
+	}
+
+	l.gpgHome = dir
+	l.gpgAgent = socket
+	return nil
+}
+
+// parseGPGDirs parses the output of gpgconf --list-dirs. Values are percent
+// escaped, like %3a for a colon in windows paths.
+func parseGPGDirs(out string) map[string]string {
+	dirs := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := url.PathUnescape(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		dirs[parts[0]] = value
+	}
+	return dirs
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGPGDirs(t *testing.T) {
+	out := "sysconfdir:/etc/gnupg\nhomedir:/home/me/.gnupg\nagent-extra-socket:/run/user/1000/gnupg/S.gpg-agent.extra\n"
+	windows := "homedir:C%3a\\Users\\me\\AppData\\Roaming\\gnupg\r\n"
+
+	var tests = []struct {
+		description string
+		out         string
+		want        map[string]string
+	}{
+		{
+			"Every line is a name and a directory",
+			out,
+			map[string]string{
+				"sysconfdir":         "/etc/gnupg",
+				"homedir":            "/home/me/.gnupg",
+				"agent-extra-socket": "/run/user/1000/gnupg/S.gpg-agent.extra",
+			},
+		},
+		{
+			"Escaped colons are unescaped",
+			windows,
+			map[string]string{"homedir": `C:\Users\me\AppData\Roaming\gnupg`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := parseGPGDirs(test.out)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardGPG(t *testing.T) {
+	home, err := ioutil.TempDir("", "lope-gnupg-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	ioutil.WriteFile(filepath.Join(home, "pubring.kbx"), []byte("public"), 0600)
+	os.Mkdir(filepath.Join(home, "private-keys-v1.d"), 0700)
+	ioutil.WriteFile(filepath.Join(home, "private-keys-v1.d", "key.key"), []byte("private"), 0600)
+
+	l := &lope{cfg: &config{}}
+	if err := l.forwardGPG("/run/user/1000/gnupg/S.gpg-agent.extra", home); err != nil {
+		t.Fatal(err)
+	}
+	defer l.cleanup()
+
+	files, err := ioutil.ReadDir(l.gpgHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"gpg.conf", "pubring.kbx"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %q want %q", names, want)
+	}
+
+	l.addVolumes()
+	l.addEnvVars()
+	got := strings.Join(l.params, " ")
+	wantParams := "-v " + l.gpgHome + ":/root/.gnupg -v /run/user/1000/gnupg/S.gpg-agent.extra:/root/.gnupg/S.gpg-agent -e GNUPGHOME=/root/.gnupg"
+	if got != wantParams {
+		t.Errorf("got %q want %q", got, wantParams)
+	}
+
+	if err := l.forwardGPG("", home); err == nil {
+		t.Errorf("got no error want an error without the extra socket")
+	}
+}
+
+func TestGPGForwardFails(t *testing.T) {
+	// Without gpgconf the agent can't be forwarded
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+
+	l := &lope{cfg: &config{gpg: true}}
+	defer l.cleanup()
+	if err := l.gpgForward(); err == nil {
+		t.Errorf("got no error want an error when gpg isn't installed")
+	}
+	if l.gpgAgent != "" {
+		t.Errorf("got agent %q want no agent to be mounted", l.gpgAgent)
+	}
+}
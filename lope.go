@@ -2,12 +2,10 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -16,20 +14,13 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-)
 
-func runBackground(args []string) error {
-	debug(fmt.Sprintf("Starting: %v\n", strings.Join(args, " ")))
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-	return nil
-}
+	"golang.org/x/term"
+)
 
 func run(args []string, stdout bool) (output string, err error) {
 	debug(fmt.Sprintf("Running: %v\n", strings.Join(args, " ")))
@@ -49,67 +40,10 @@ func run(args []string, stdout bool) (output string, err error) {
 	return out.String(), err
 }
 
-func buildImage(image string, dockerfile string) (string, error) {
-	file, err := ioutil.TempFile(path("./"), image)
-	defer os.Remove(file.Name())
-
-	_, err = file.WriteString(dockerfile)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	build := make([]string, 0)
-	build = append(build, "docker", "build", "-t", image, "-f", file.Name(), ".")
-	out, err := run(build, false)
-	debug(out)
-	return out, err
-}
-
 func path(p string) string {
 	return filepath.FromSlash(p)
 }
 
-func cmdProxy(w http.ResponseWriter, r *http.Request) {
-	type message struct {
-		Command string   `json:"command"`
-		Args    []string `json:"args"`
-	}
-
-	b, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	var msg message
-	err = json.Unmarshal(b, &msg)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	c := exec.Command(msg.Command, msg.Args...)
-	out, err := c.CombinedOutput()
-	if err != nil {
-		fmt.Println(string(out), err)
-	}
-
-	w.Header().Set("content-type", "application/json")
-	w.Write(out)
-}
-
-func getIPAddress() (ip string) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr).IP.String()
-	return localAddr
-}
-
 type image struct {
 	params []string
 }
@@ -121,13 +55,22 @@ type config struct {
 	dir          string
 	docker       bool
 	dockerSocket string
-	entrypoint   string
-	blacklist    []string
-	whitelist    []string
-	home         string
+	runtimeName  string
+	// session is unique for every invocation of lope so that names of the
+	// resources it creates don't clash with other lopes running at the same time
+	session    string
+	entrypoint string
+	blacklist  []string
+	whitelist  []string
+	home       string
+	// context is the source of the files in the build context
+	context string
+	// ignore are extra .dockerignore patterns for the build context
+	ignore       []string
 	image        string
 	mount        bool
 	os           string
+	rebuild      bool
 	root         bool
 	sourceImage  string
 	cmdProxy     bool
@@ -137,6 +80,44 @@ type config struct {
 	paths        []string
 	tty          bool
 	workDir      string
+	// containerRuntime is used to build images and run containers
+	containerRuntime Runtime
+	// cmdProxyAllow are the commands the command proxy is allowed to run
+	cmdProxyAllow []proxyRule
+	// cmdProxyEnv are regexes of environment variables that proxied commands
+	// get from the container
+	cmdProxyEnv []string
+	// cmdProxySocket makes the command proxy listen on a unix socket
+	cmdProxySocket bool
+	// proxyCommands are the names the command proxy client is installed as
+	proxyCommands []string
+	// cmdProxyLog is a file the command proxy appends an audit log to, with
+	// arguments matching cmdProxyRedact hidden
+	cmdProxyLog    string
+	cmdProxyRedact []string
+	// cmdProxyMaxCommands, cmdProxyTimeout and cmdProxyMaxOutput limit the
+	// commands the command proxy runs, zero is unlimited
+	cmdProxyMaxCommands int
+	cmdProxyTimeout     time.Duration
+	cmdProxyMaxOutput   int64
+	// cmdProxyDirs are host directories lope-cp can copy files to and from
+	cmdProxyDirs []string
+	// sshKeys are the fingerprints or comment regexes of the keys of the ssh
+	// agent that are forwarded, all keys are forwarded when it is empty
+	sshKeys []string
+	// sshConfirm asks on the host before a forwarded key is used
+	sshConfirm bool
+	// sshTimeout is how long lope waits for the ssh agent to answer
+	sshTimeout time.Duration
+	// gpg forwards the gpg agent into the container
+	gpg bool
+	// exitCleanup is run when lope exits right away on a second signal, for
+	// what outlives a single container like the artifacts of a pipeline
+	exitCleanup func()
+	// envFiles are dotenv files whose variables are set in the container
+	envFiles []string
+	// fileEnvs are the NAME=value pairs loaded from envFiles
+	fileEnvs []string
 }
 
 type lope struct {
@@ -144,6 +125,126 @@ type lope struct {
 	dockerfile string
 	envs       []string
 	params     []string
+	// runEnv has the values of variables that params pass by name so that
+	// they aren't on the command line of the runtime
+	runEnv []string
+	// name is the name given to the container. Docker generates one when empty
+	name string
+	// create only creates the container so that files can be copied into it
+	// before it is started. The container is not removed when it exits.
+	create bool
+	// cleanups remove everything that was started for this run
+	cleanups []func()
+	// sourceDigest and contextDigest are part of the tag of the built image
+	sourceDigest  string
+	contextDigest string
+	// proxyTempDir is shared with the container for the command proxy
+	proxyTempDir string
+	// sshAgent is the socket of the ssh agent on the host that is mounted
+	// into the container
+	sshAgent string
+	// gpgAgent is the extra socket of the gpg agent on the host and gpgHome
+	// the directory with the public keyring that is mounted as GNUPGHOME
+	gpgAgent string
+	gpgHome  string
+	// mu guards cleanups, started and interrupted which are also used by the
+	// signal handler
+	mu          sync.Mutex
+	started     bool
+	interrupted os.Signal
+}
+
+// imageTag returns a content addressed tag for the image that is built from
+// the generated dockerfile. The digest of the source image and of the build
+// context are part of the address so that the image is rebuilt when either
+// of them changes.
+func (l *lope) imageTag() string {
+	h := sha256.New()
+	fmt.Fprintln(h, l.cfg.sourceImage)
+	fmt.Fprintln(h, l.sourceDigest)
+	fmt.Fprintln(h, l.dockerfile)
+	fmt.Fprintln(h, l.contextDigest)
+	return fmt.Sprintf("lope:%x", h.Sum(nil)[:6])
+}
+
+func (l *lope) buildContext() *buildContext {
+	return &buildContext{
+		dir:    path("./"),
+		ignore: l.cfg.ignore,
+		source: l.cfg.context,
+	}
+}
+
+// tagImage gives the image that will be built a content addressed tag
+func (l *lope) tagImage() {
+	if l.cfg.image == l.cfg.sourceImage {
+		return
+	}
+
+	// The source image might not have been pulled yet. In that case it will
+	// be pulled during the build and the next run will rebuild once.
+	l.sourceDigest, _ = l.cfg.containerRuntime.ImageID(l.cfg.sourceImage)
+
+	if l.cfg.addMount {
+		digest, err := l.buildContext().hash()
+		if err != nil {
+			// Without a digest of the context always rebuild to be safe
+			debug(fmt.Sprintf("Failed to hash the build context: %v\n", err))
+			digest = randomID()
+			l.addCleanup(func() {
+				l.cfg.containerRuntime.RemoveImage(l.cfg.image)
+			})
+		}
+		l.contextDigest = digest
+	}
+
+	l.cfg.image = l.imageTag()
+}
+
+// addCleanup registers a function that is run once lope is done
+func (l *lope) addCleanup(f func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanups = append(l.cleanups, f)
+}
+
+// cleanup runs the registered cleanups in reverse order. The signal handler
+// runs them too when lope exits right away.
+func (l *lope) cleanup() {
+	l.mu.Lock()
+	cleanups := l.cleanups
+	l.cleanups = nil
+	l.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// binary is the command line client of the configured container runtime
+func (c *config) binary() string {
+	if c.runtimeName == "" {
+		return "docker"
+	}
+	return c.runtimeName
+}
+
+// geteuid is replaced in tests to run as root or as a user
+var geteuid = os.Geteuid
+
+// defaultSocket returns the socket of the container runtime which is mounted
+// into the container as the docker socket. nerdctl doesn't have a docker
+// compatible socket so nothing is mounted by default.
+func defaultSocket(runtimeName string) string {
+	switch runtimeName {
+	case "podman":
+		if dir, ok := os.LookupEnv("XDG_RUNTIME_DIR"); ok && geteuid() != 0 {
+			return dir + "/podman/podman.sock"
+		}
+		return "/run/podman/podman.sock"
+	case "nerdctl":
+		return ""
+	}
+	return "/var/run/docker.sock"
 }
 
 func (l *lope) createDockerfile() {
@@ -187,19 +288,23 @@ func (l *lope) cleanEnvVars() {
 	}
 }
 
+// addEnvVars passes the environment variables of the host by name. Variables
+// from env files override the host variable of the same name. They are passed
+// by name too so that their values don't end up on the command line. They
+// were listed explicitly so the whitelist doesn't apply to them, the blacklist
+// does.
 func (l *lope) addEnvVars() {
+	fromFile := make(map[string]bool)
+	for _, e := range l.cfg.fileEnvs {
+		fromFile[strings.SplitN(e, "=", 2)[0]] = true
+	}
 	for _, e := range l.envs {
 		pair := strings.Split(e, "=")
 		name := pair[0]
-		add := true
-		blacklisted := false
-		for _, b := range l.cfg.blacklist {
-			matched, _ := regexp.MatchString(b, name)
-			if matched {
-				blacklisted = true
-				break
-			}
+		if fromFile[name] {
+			continue
 		}
+		add := true
 		if len(l.cfg.whitelist) > 0 {
 			add = false
 		}
@@ -210,23 +315,45 @@ func (l *lope) addEnvVars() {
 				break
 			}
 		}
-		if add && !blacklisted {
+		if add && !l.blacklisted(name) {
 			l.params = append(l.params, "-e", name)
 		}
 	}
-	if l.cfg.ssh {
-		l.params = append(l.params,
-			"-e", "SSH_AUTH_SOCK=/ssh-agent/ssh-agent.sock",
-		)
+	for _, e := range l.cfg.fileEnvs {
+		pair := strings.SplitN(e, "=", 2)
+		if !l.blacklisted(pair[0]) {
+			l.containerEnv(pair[0], pair[1])
+		}
+	}
+	if l.sshAgent != "" {
+		l.params = append(l.params, "-e", "SSH_AUTH_SOCK="+sshAgentSocket)
+	}
+	if l.gpgAgent != "" {
+		l.params = append(l.params, "-e", "GNUPGHOME="+gpgHome)
+	}
+}
+
+func (l *lope) blacklisted(name string) bool {
+	for _, b := range l.cfg.blacklist {
+		matched, _ := regexp.MatchString(b, name)
+		if matched {
+			return true
+		}
 	}
+	return false
 }
 
 func (l *lope) defaultParams() {
+	if l.create {
+		l.params = append(l.params, l.cfg.binary(), "create")
+	} else {
+		l.params = append(l.params, l.cfg.binary(), "run", "--rm")
+	}
+	if l.name != "" {
+		l.params = append(l.params, "--name", l.name)
+	}
 	l.params = append(
 		l.params,
-		"docker",
-		"run",
-		"--rm",
 		"--interactive",
 		"--entrypoint", l.cfg.entrypoint,
 		"--workdir", l.cfg.workDir,
@@ -240,25 +367,45 @@ func (l *lope) defaultParams() {
 	}
 }
 
-func (l *lope) addVolumes() {
-	for _, p := range l.cfg.paths {
-		absPath := l.cfg.home + p
+// mount is a directory or file from the host that is bind mounted into the
+// container
+type mount struct {
+	host      string
+	container string
+}
+
+// mounts returns the paths from the home directory and the working directory
+// that are bind mounted into the container
+func (c *config) mounts() []mount {
+	mounts := []mount{}
+	for _, p := range c.paths {
+		absPath := c.home + p
 		if _, err := os.Stat(absPath); err == nil {
-			volume := fmt.Sprintf("%v:/root/%v", absPath, p)
-			debug(fmt.Sprintf("Adding volume %q\n", volume))
-			l.params = append(l.params, "-v", volume)
+			mounts = append(mounts, mount{host: absPath, container: "/root/" + p})
 		}
 	}
-	if l.cfg.mount {
-		path := fmt.Sprintf("%v:%v", l.cfg.dir, l.cfg.workDir)
-		l.params = append(l.params, "-v", path)
+	if c.mount {
+		mounts = append(mounts, mount{host: c.dir, container: c.workDir})
 	}
-	if l.cfg.docker {
+	return mounts
+}
+
+func (l *lope) addVolumes() {
+	for _, m := range l.cfg.mounts() {
+		volume := fmt.Sprintf("%v:%v", m.host, m.container)
+		debug(fmt.Sprintf("Adding volume %q\n", volume))
+		l.params = append(l.params, "-v", volume)
+	}
+	if l.cfg.docker && l.cfg.dockerSocket != "" {
 		l.params = append(l.params, "-v", l.cfg.dockerSocket+":/var/run/docker.sock")
 	}
-	if l.cfg.ssh {
+	if l.sshAgent != "" {
+		l.params = append(l.params, "-v", l.sshAgent+":"+sshAgentSocket)
+	}
+	if l.gpgAgent != "" {
 		l.params = append(l.params,
-			"-v", "lope-ssh-agent:/ssh-agent",
+			"-v", l.gpgHome+":"+gpgHome,
+			"-v", l.gpgAgent+":"+gpgHome+"/S.gpg-agent",
 		)
 	}
 }
@@ -269,6 +416,13 @@ func (l *lope) addUserAndGroup() {
 		return
 	}
 
+	// Rootless podman maps the current user into the container itself. As
+	// root podman refuses keep-id and the user is set like for docker.
+	if l.cfg.runtimeName == "podman" && geteuid() != 0 {
+		l.params = append(l.params, "--userns=keep-id")
+		return
+	}
+
 	u, err := user.Current()
 	// If we can't get the current user and group just ignore this since this is only a nice way
 	// to avoid screwing up permissions for any files created in the bind mounted directory for
@@ -297,106 +451,117 @@ func (l *lope) runParams() {
 	l.params = append(l.params, l.cfg.image, "-c", strings.Join(l.cfg.cmd, " "))
 }
 
-func (l *lope) sshForward() {
-
-	if !l.cfg.ssh {
-		return
+func (l *lope) commandProxy() error {
+	if !l.cfg.cmdProxy {
+		return nil
 	}
 
-	// Get ssh keys currently added to ssh agent
-	k := make([]string, 0)
-	k = append(k, "ssh-add", "-L")
-	authorizedKeys, _ := run(k, false)
-	authorizedKeys = base64.StdEncoding.EncodeToString([]byte(authorizedKeys))
-
-	image := "uber/ssh-agent-forward:latest"
-	name := "lope-sshd"
-	volume := "lope-ssh-agent"
-	port := "2244"
-	host := "127.0.0.1"
-
-	// Create a volume to mount our ssh-agent into
-	r := make([]string, 0)
-	r = append(r, "docker", "volume", "create", "--name", volume)
-	run(r, false)
-
-	// Start the ssh server where we will forward our agent to
-	p := make([]string, 0)
-	p = append(
-		p,
-		"docker", "run",
-		"--rm",
-		"--name", name,
-		"-e", "AUTHORIZED_KEYS="+authorizedKeys,
-		"-v", volume+":/ssh-agent",
-		"-d",
-		"-p", port+":22",
-		image,
-	)
-	run(p, false)
-
-	// Wait for the ssh server to be responding
-	w := make([]string, 0)
-	w = append(
-		w,
-		"ssh",
-		"-A",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "GlobalKnownHostsFile=/dev/null",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-p", port,
-		"root@"+host,
-		"ls",
-	)
-
-	for i := 1; i <= 10; i++ {
-		_, err := run(w, false)
+	proxy, err := newProxyServer(l.cfg.cmdProxyAllow)
+	if err != nil {
+		return err
+	}
+	proxy.mounts = proxyMounts(l.cfg)
+	proxy.env = l.cfg.cmdProxyEnv
+	proxy.limits.maxCommands = l.cfg.cmdProxyMaxCommands
+	proxy.limits.timeout = l.cfg.cmdProxyTimeout
+	proxy.limits.maxOutput = l.cfg.cmdProxyMaxOutput
+	proxy.dirs, err = parseTransferDirs(l.cfg.cmdProxyDirs)
+	if err != nil {
+		return err
+	}
+	if l.cfg.cmdProxyLog != "" {
+		audit, err := newAuditLog(l.cfg.cmdProxyLog, l.cfg.cmdProxyRedact, l.cfg.session, l.cfg.sourceImage)
 		if err != nil {
-			time.Sleep(3 * time.Second)
-		} else {
-			break
+			return fmt.Errorf("failed to open the audit log: %w", err)
 		}
+		l.addCleanup(func() {
+			audit.close()
+		})
+		proxy.audit = audit
 	}
 
-	// Forward ssh agent into the container
-	s := make([]string, 0)
-	s = append(
-		s,
-		"ssh",
-		"-A",
-		"-f",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "GlobalKnownHostsFile=/dev/null",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-p", port,
-		"-S", "none",
-		"root@"+host,
-		"/ssh-entrypoint.sh",
-	)
-
-	err := runBackground(s)
+	listener, address, err := l.proxyListener()
 	if err != nil {
-		fmt.Print("Failed to forward SSH agent", err)
+		return err
 	}
-}
+	server := &http.Server{Handler: proxy}
+	go server.Serve(listener)
+	l.addCleanup(func() {
+		server.Close()
+	})
 
-func (l *lope) commandProxy() {
-	if !l.cfg.cmdProxy {
-		return
-	}
+	l.params = append(l.params, "-e", "LOPE_PROXY_ADDR="+address)
+	l.containerEnv("LOPE_PROXY_TOKEN", proxy.token)
 
-	http.HandleFunc("/", cmdProxy)
-	address := ":" + l.cfg.cmdProxyPort
+	if err := l.installProxyClient(); err != nil {
+		return fmt.Errorf("failed to install the client: %w", err)
+	}
+	return nil
+}
 
-	debug(fmt.Sprintf("Starting lope command proxy server on address: %q", address))
+// containerEnv sets a variable in the container without putting its value on
+// the command line of the runtime, where every local user can read it with ps.
+// The value is only added to the environment of the command that runs the
+// container.
+func (l *lope) containerEnv(name string, value string) {
+	l.runEnv = append(l.runEnv, name+"="+value)
+	l.params = append(l.params, "-e", name)
+}
 
-	go http.ListenAndServe(address, nil)
+// proxyMountDir is where the directory with the unix socket and the client of
+// the command proxy is mounted in the container
+const proxyMountDir = "/lope-proxy"
 
-	ip := getIPAddress()
+// proxyDir returns the temporary directory that is mounted into the container
+// for the command proxy. It is created the first time it is needed.
+func (l *lope) proxyDir() (string, error) {
+	if l.proxyTempDir != "" {
+		return l.proxyTempDir, nil
+	}
+	dir, err := ioutil.TempDir("", "lope-proxy")
+	if err != nil {
+		return "", err
+	}
+	l.addCleanup(func() {
+		os.RemoveAll(dir)
+	})
+	l.params = append(l.params, "-v", dir+":"+proxyMountDir)
+	l.proxyTempDir = dir
+	return dir, nil
+}
 
-	l.params = append(l.params, "--add-host=localhost:"+ip)
+// proxyListener listens either on a TCP port on localhost or on a unix socket
+// in the proxy directory. It returns the address of the command proxy inside
+// of the container.
+func (l *lope) proxyListener() (net.Listener, string, error) {
+	if !l.cfg.cmdProxySocket {
+		// Only listen on localhost so that nobody else on the network can reach
+		// it. Without a port a free one is picked so that lopes can run at the
+		// same time.
+		port := l.cfg.cmdProxyPort
+		if port == "" {
+			port = "0"
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			return nil, "", err
+		}
+		debug(fmt.Sprintf("Starting lope command proxy server on address: %q\n", listener.Addr()))
+		port = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		return listener, "http://" + proxyHost(l.cfg) + ":" + port, nil
+	}
 
-	l.params = append(l.params, "-e", "LOPE_PROXY_ADDR=http://"+ip+":"+l.cfg.cmdProxyPort)
+	dir, err := l.proxyDir()
+	if err != nil {
+		return nil, "", err
+	}
+	socket := filepath.Join(dir, "proxy.sock")
+	debug(fmt.Sprintf("Starting lope command proxy server on socket: %q\n", socket))
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, "", err
+	}
+	return listener, "unix://" + proxyMountDir + "/proxy.sock", nil
 }
 
 func debug(message string) {
@@ -405,17 +570,72 @@ func debug(message string) {
 	}
 }
 
-func (l *lope) run() []string {
-	l.sshForward()
+func (l *lope) run() ([]string, error) {
 	l.createDockerfile()
+	l.tagImage()
 	l.defaultParams()
-	l.commandProxy()
+	if err := l.commandProxy(); err != nil {
+		return nil, fmt.Errorf("failed to start the command proxy: %w", err)
+	}
 	l.addVolumes()
 	l.cleanEnvVars()
 	l.addEnvVars()
 	l.addUserAndGroup()
 	l.runParams()
-	return l.params
+	return l.params, nil
+}
+
+// prepare generates the docker parameters and builds the image if needed
+func (l *lope) prepare() ([]string, error) {
+	if err := l.sshForward(); err != nil {
+		return nil, fmt.Errorf("failed to forward the ssh agent: %w", err)
+	}
+	if err := l.gpgForward(); err != nil {
+		return nil, fmt.Errorf("failed to forward the gpg agent: %w", err)
+	}
+	params, err := l.run()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.cfg.image != l.cfg.sourceImage {
+		if _, err := l.cfg.containerRuntime.ImageID(l.cfg.image); err == nil && !l.cfg.rebuild {
+			debug(fmt.Sprintf("Image %q is up to date, skipping the build\n", l.cfg.image))
+			return params, nil
+		}
+		name := "Dockerfile-" + l.cfg.session
+		archive := l.buildContext().archive(name, l.dockerfile)
+		out, err := l.cfg.containerRuntime.Build(l.cfg.image, archive, name)
+		if err != nil {
+			fmt.Println(out)
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// execute builds the image if needed and runs the command for a single config
+func execute(cfg *config) error {
+	lope := lope{
+		cfg:    cfg,
+		envs:   os.Environ(),
+		params: make([]string, 0),
+		name:   "lope-" + randomID(),
+	}
+
+	defer lope.cleanup()
+	stop := lope.handleSignals()
+	defer stop()
+
+	params, err := lope.prepare()
+	if err != nil {
+		return err
+	}
+
+	if err := lope.start(); err != nil {
+		return err
+	}
+	return cfg.containerRuntime.Run(params, lope.runEnv)
 }
 
 type flagArray []string
@@ -432,6 +652,12 @@ func (i *flagArray) Set(value string) error {
 var instructions flagArray
 var mountPaths flagArray
 var extraArgs flagArray
+var cmdProxyAllow flagArray
+var proxyCommands flagArray
+var cmdProxyRedact flagArray
+var cmdProxyDirs flagArray
+var sshKeys flagArray
+var envFiles flagArray
 
 func main() {
 
@@ -458,13 +684,27 @@ func main() {
 
 	noMount := flag.Bool("noMount", false, "Disable mounting the current working directory into the image")
 
+	context := flag.String("context", "dir", "Files to send as the build context when building an image. One of dir (every file in the directory), git (files tracked by git) or git-untracked (also include untracked files not ignored by git)")
+
 	addMount := flag.Bool("addMount", false, "Setting this will add the directory into the image instead of mounting it")
 
 	noDocker := flag.Bool("noDocker", false, "Disables mounting the docker socket inside the container")
 
 	ssh := flag.Bool("ssh", false, "Enable forwarding ssh agent into the container")
 
-	dockerSocket := flag.String("dockerSocket", "/var/run/docker.sock", "Path to the docker socket")
+	gpg := flag.Bool("gpg", false, "Forward the gpg agent into the container together with the public keyring of the host")
+
+	flag.Var(&sshKeys, "sshKey", "Only forward the keys of the ssh agent with this fingerprint (SHA256:... or MD5:...) or with a comment matching this regex. Can be specified multiple times")
+
+	sshTimeout := flag.Duration("sshTimeout", 10*time.Second, "How long to wait for the ssh agent to answer before giving up")
+
+	sshConfirm := flag.Bool("sshConfirm", false, "Ask on the host before the container can use a key of the forwarded ssh agent. Needs SSH_ASKPASS when lope runs in a terminal")
+
+	flag.Var(&envFiles, "envFile", "Load environment variables for the container from this dotenv file. Can be specified multiple times, later files override earlier ones")
+
+	dockerSocket := flag.String("dockerSocket", "", "Path to the docker socket. Default is the socket of the container runtime")
+
+	runtimeName := flag.String("runtime", "docker", "Container runtime to use. One of docker, podman or nerdctl")
 
 	workDir := flag.String("workDir", "/lope", "The default working directory for the docker image")
 
@@ -474,17 +714,42 @@ func main() {
 
 	noRoot := flag.Bool("noRoot", false, "Use current user instead of the root user")
 
+	rebuild := flag.Bool("rebuild", false, "Always build the image even if an image for the same instructions already exists")
+
 	cmdProxy := flag.Bool("cmdProxy", false, "Starts a server that the lope container can use to run commands on the host")
 
-	cmdProxyPort := flag.String("cmdProxyPort", "24242", "Listening port that will be used for the lope command proxy")
+	cmdProxyPort := flag.String("cmdProxyPort", "", "Listening port that will be used for the lope command proxy. Default is a free port")
+
+	cmdProxySocket := flag.Bool("cmdProxySocket", false, "Use a unix socket that is mounted into the container for the command proxy instead of a port")
+
+	var cmdProxyEnv string
+	flag.StringVar(&cmdProxyEnv, "cmdProxyEnv", "", "Comma seperated list of environment variables that commands run by the command proxy get from the container")
+
+	cmdProxyLog := flag.String("cmdProxyLog", "", "File the command proxy appends a JSON line to for every command it is asked to run")
+
+	cmdProxyMaxCommands := flag.Int("cmdProxyMaxCommands", 8, "Maximum number of commands the command proxy runs at the same time. 0 is unlimited")
+
+	cmdProxyTimeout := flag.Duration("cmdProxyTimeout", 0, "Time after which a command run by the command proxy is killed together with everything it started (e.g. 10m). 0 is unlimited")
+
+	cmdProxyMaxOutput := flag.Int64("cmdProxyMaxOutput", 0, "Bytes of output after which a command run by the command proxy is killed. 0 is unlimited")
+
+	flag.Var(&cmdProxyDirs, "cmdProxyDir", "Host directory that lope-cp in the container can copy files to and from, as name=path or just a path to use the name of the directory. Starts the command proxy. Can be specified multiple times")
+
+	flag.Var(&cmdProxyRedact, "cmdProxyRedact", "Regex of secret arguments that are redacted in the command proxy log. Only the value is redacted for arguments like --password=secret. Can be specified multiple times")
+
+	flag.Var(&proxyCommands, "proxy", "Command that is run on the host through the command proxy. The command proxy client is installed in the container under this name and the command is allowed. Can be specified multiple times")
+
+	flag.Var(&cmdProxyAllow, "cmdProxyAllow", "Command the command proxy is allowed to run, optionally followed by a colon and a regex every argument has to match (e.g. git:status|log). Can be specified multiple times")
+
+	configFile := flag.String("config", "", "Path to a lope config file. Default is the first .lope.yml found in the current directory or its parents up to the repository root")
 
 	flag.Parse()
-	if flag.NArg() < 2 {
-		fmt.Fprintf(os.Stderr, "Usage of %[1]s:\n  %[1]s [options] <docker-image> <command>\n\nOptions:\n", filepath.Base(os.Args[0]))
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
-	args := flag.Args()
+
+	// Keep track of which flags were explicitly set so they can override the config file
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
 
 	mount := !*addMount && !*noMount
 
@@ -506,12 +771,15 @@ func main() {
 		addDocker:    *addDocker,
 		addMount:     *addMount,
 		blacklist:    strings.Split(blacklist, ","),
-		cmd:          args[1:],
+		cmd:          []string{},
 		cmdProxy:     *cmdProxy,
 		cmdProxyPort: *cmdProxyPort,
+		context:      *context,
 		dir:          *dir,
 		docker:       !*noDocker,
 		dockerSocket: *dockerSocket,
+		runtimeName:  *runtimeName,
+		session:      randomID(),
 		entrypoint:   *entrypoint,
 		home:         home,
 		image:        "lope",
@@ -519,32 +787,123 @@ func main() {
 		mount:        mount,
 		os:           runtime.GOOS,
 		paths:        paths,
+		rebuild:      *rebuild,
 		root:         !*noRoot,
-		sourceImage:  args[0],
+		sourceImage:  "",
 		ssh:          *ssh,
 		tty:          !*noTty,
 		whitelist:    strings.Split(whitelist, ","),
 		workDir:      *workDir,
 	}
+	config.cmdProxySocket = *cmdProxySocket
+	config.proxyCommands = proxyCommands
+	config.cmdProxyLog = *cmdProxyLog
+	config.cmdProxyRedact = cmdProxyRedact
+	config.cmdProxyMaxCommands = *cmdProxyMaxCommands
+	config.cmdProxyTimeout = *cmdProxyTimeout
+	config.cmdProxyMaxOutput = *cmdProxyMaxOutput
+	config.cmdProxyDirs = cmdProxyDirs
+	config.sshKeys = sshKeys
+	config.sshConfirm = *sshConfirm
+	config.sshTimeout = *sshTimeout
+	config.gpg = *gpg
+	config.envFiles = envFiles
+	if cmdProxyEnv != "" {
+		config.cmdProxyEnv = strings.Split(cmdProxyEnv, ",")
+	}
+	for _, a := range cmdProxyAllow {
+		config.cmdProxyAllow = append(config.cmdProxyAllow, parseProxyRule(a))
+	}
+
+	var stages []stage
+	if *configFile == "" {
+		if file, ok := findConfigFile(pwd); ok {
+			*configFile = file
+		}
+	}
+	if *configFile != "" {
+		fc, err := loadConfigFile(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitConfig)
+		}
+		debug(fmt.Sprintf("Loaded config file %q\n", *configFile))
+		fc.apply(config, set)
+		stages = fc.Stages
+	}
 
-	lope := lope{
-		cfg:    config,
-		envs:   os.Environ(),
-		params: make([]string, 0),
+	if config.context != "dir" && config.context != "git" && config.context != "git-untracked" {
+		fmt.Fprintf(os.Stderr, "Unknown build context %q, must be one of dir, git or git-untracked\n", config.context)
+		os.Exit(exitConfig)
 	}
 
-	params := lope.run()
+	config.allowProxyCommands()
+	if _, err := compileProxyRules(config.cmdProxyAllow); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	if _, err := parseTransferDirs(config.cmdProxyDirs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	if _, err := compileSSHKeys(config.sshKeys); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	if config.ssh && config.sshConfirm {
+		if err := checkConfirm(os.Getenv("SSH_ASKPASS"), term.IsTerminal(int(os.Stdin.Fd()))); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitConfig)
+		}
+	}
+	if _, err := compileRedact(config.cmdProxyRedact); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	fileEnvs, err := loadEnvFiles(config.envFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load env file:", err)
+		os.Exit(exitConfig)
+	}
+	config.fileEnvs = fileEnvs
 
-	if lope.cfg.image != lope.cfg.sourceImage {
-		out, err := buildImage(lope.cfg.image, lope.dockerfile)
+	if config.dockerSocket == "" {
+		config.dockerSocket = defaultSocket(config.runtimeName)
+	}
+
+	containerRuntime, err := newRuntime(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitRuntime)
+	}
+	config.containerRuntime = containerRuntime
+
+	if len(stages) > 0 && (flag.NArg() == 0 || flag.NArg() == 2 && flag.Arg(0) == "run") {
+		err = runPipeline(config, stages, flag.Arg(1))
 		if err != nil {
-			fmt.Println(out)
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCode(err))
 		}
+		return
 	}
 
-	_, err := run(params, true)
+	if flag.NArg() >= 2 {
+		config.sourceImage = flag.Arg(0)
+		config.cmd = flag.Args()[1:]
+	}
+
+	if flag.NArg() == 1 || config.sourceImage == "" || len(config.cmd) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage of %[1]s:\n  %[1]s [options] <docker-image> <command>\n  %[1]s [options] [run <stage>]\n\nOptions:\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(exitConfig)
+	}
+
+	err = execute(config)
 	if err != nil {
-		os.Exit(1)
+		// Failures of the command itself have already been printed by the container
+		if _, ok := containerExit(err); !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitCode(err))
 	}
 }
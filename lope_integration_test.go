@@ -16,7 +16,7 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	cmd = exec.Command("go", "build", "-o", "lope", "cmdProxy.go")
+	cmd = exec.Command("go", "build", "-o", "lope", ".")
 	cmd.Env = os.Environ()
 	cmd.Env = append(
 		cmd.Env,
@@ -80,10 +80,12 @@ func TestLopeCli(t *testing.T) {
 			[]string{
 				"-noTty",
 				"-cmdProxy",
+				"-cmdProxyAllow", "lope",
 				"alpine",
 				"wget", "-q", "-O-",
 				`--post-data='{"command":"lope", "args": ["-noTty", "alpine", "ls"]}'`,
 				"--header=Content-Type:application/json",
+				`--header="Authorization: Bearer $LOPE_PROXY_TOKEN"`,
 				"$LOPE_PROXY_ADDR",
 			},
 			[]string{
@@ -95,6 +97,7 @@ func TestLopeCli(t *testing.T) {
 			[]string{
 				"-noTty",
 				"-cmdProxy",
+				"-cmdProxyAllow", "lope",
 				"alpine",
 				"cmdProxy/lope", "-noTty", "alpine", "ls",
 			},
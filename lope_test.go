@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -94,7 +95,7 @@ func TestAddVolumes(t *testing.T) {
 		home        string
 		mount       bool
 		docker      bool
-		ssh         bool
+		sshAgent    string
 		dir         string
 		want        string
 	}{
@@ -104,7 +105,7 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			false,
 			false,
-			false,
+			"",
 			"",
 			fmt.Sprintf("-v %v.aws:/root/.aws", path("./test/")),
 		},
@@ -114,7 +115,7 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			false,
 			false,
-			false,
+			"",
 			"",
 			fmt.Sprintf("-v %v.aws:/root/.aws", path("./test/")),
 		},
@@ -124,7 +125,7 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			false,
 			false,
-			false,
+			"",
 			"",
 			"",
 		},
@@ -134,7 +135,7 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			true,
 			false,
-			false,
+			"",
 			"/home/user/pro/lope/",
 			"-v /home/user/pro/lope/:/lope",
 		},
@@ -144,7 +145,7 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			false,
 			false,
-			false,
+			"",
 			"",
 			fmt.Sprintf("-v %v.aws:/root/.aws -v %v.kube:/root/.kube", path("./test/"), path("./test/")),
 		},
@@ -154,19 +155,19 @@ func TestAddVolumes(t *testing.T) {
 			path("./test/"),
 			false,
 			true,
-			false,
+			"",
 			"",
 			"-v /var/run/docker.sock:/var/run/docker.sock",
 		},
 		{
-			"Mount ssh volumes if ssh is enabled",
+			"Mount the ssh agent socket if ssh is enabled",
 			[]string{},
 			path("./test/"),
 			false,
 			false,
-			true,
+			"/tmp/ssh-agent.sock",
 			"",
-			"-v lope-ssh-agent:/ssh-agent",
+			"-v /tmp/ssh-agent.sock:/ssh-agent/ssh-agent.sock",
 		},
 	}
 
@@ -178,7 +179,7 @@ func TestAddVolumes(t *testing.T) {
 			l.cfg.mount = test.mount
 			l.cfg.dir = test.dir
 			l.cfg.docker = test.docker
-			l.cfg.ssh = test.ssh
+			l.sshAgent = test.sshAgent
 			l.addVolumes()
 
 			got := strings.Join(l.params, " ")
@@ -198,67 +199,124 @@ func TestAddEnvVars(t *testing.T) {
 		envs        []string
 		blacklist   []string
 		whitelist   []string
-		ssh         bool
+		fileEnvs    []string
+		sshAgent    string
 		want        string
+		runEnv      []string
 	}{
 		{
 			"Add an env var",
 			[]string{"ENV1=hello1"},
 			[]string{},
 			[]string{},
-			false,
+			nil,
+			"",
 			"-e ENV1",
+			nil,
 		},
 		{
 			"Add multiple env vars",
 			[]string{"ENV1=hello1", "ENV2=hello2"},
 			[]string{},
 			[]string{},
-			false,
+			nil,
+			"",
 			"-e ENV1 -e ENV2",
+			nil,
 		},
 		{
 			"Blacklist an env var",
 			[]string{"ENV1=hello1"},
 			[]string{"ENV1"},
 			[]string{},
-			false,
+			nil,
 			"",
+			"",
+			nil,
 		},
 		{
 			"Whitelist an env var",
 			[]string{"ENV1=hello1", "ENV2=hello2", "NO=no"},
 			[]string{},
 			[]string{"ENV"},
-			false,
+			nil,
+			"",
 			"-e ENV1 -e ENV2",
+			nil,
 		},
 		{
 			"Blacklist and whitelisting env vars",
 			[]string{"ENV1=hello1", "ENV2=hello2", "NO=no"},
 			[]string{"ENV1"},
 			[]string{"ENV"},
-			false,
+			nil,
+			"",
 			"-e ENV2",
+			nil,
 		},
 		{
 			"Add the SSH auth socket if ssh is enabled",
 			[]string{},
 			[]string{},
 			[]string{},
-			true,
+			nil,
+			"/tmp/ssh-agent.sock",
 			"-e SSH_AUTH_SOCK=/ssh-agent/ssh-agent.sock",
+			nil,
+		},
+		{
+			"Add env vars from env files with their value",
+			[]string{"ENV1=hello1"},
+			[]string{},
+			[]string{},
+			[]string{"FILE=from file"},
+			"",
+			"-e ENV1 -e FILE",
+			[]string{"FILE=from file"},
+		},
+		{
+			"Env files override host env vars",
+			[]string{"ENV1=hello1", "ENV2=hello2"},
+			[]string{},
+			[]string{},
+			[]string{"ENV1=from file"},
+			"",
+			"-e ENV2 -e ENV1",
+			[]string{"ENV1=from file"},
+		},
+		{
+			"Env files aren't filtered by the whitelist",
+			[]string{"NO=no"},
+			[]string{},
+			[]string{"ENV"},
+			[]string{"FILE=yes"},
+			"",
+			"-e FILE",
+			[]string{"FILE=yes"},
+		},
+		{
+			"Env files are filtered by the blacklist",
+			[]string{},
+			[]string{"SECRET"},
+			[]string{},
+			[]string{"SECRET=no", "FILE=yes"},
+			"",
+			"-e FILE",
+			[]string{"FILE=yes"},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
 			l.params = make([]string, 0)
+			l.runEnv = nil
 			l.envs = test.envs
 			l.cfg.blacklist = test.blacklist
 			l.cfg.whitelist = test.whitelist
-			l.cfg.ssh = test.ssh
+			l.cfg.fileEnvs = test.fileEnvs
+			l.sshAgent = test.sshAgent
 			l.addEnvVars()
+			defer l.cleanup()
 
 			got := strings.Join(l.params, " ")
 			want := test.want
@@ -266,6 +324,10 @@ func TestAddEnvVars(t *testing.T) {
 			if got != want {
 				t.Errorf("got %q want %q", got, want)
 			}
+			// The values of env files are only handed to the runtime command
+			if !reflect.DeepEqual(l.runEnv, test.runEnv) {
+				t.Errorf("got runtime env %q want %q", l.runEnv, test.runEnv)
+			}
 		})
 	}
 }
@@ -276,20 +338,47 @@ func TestDefaultParams(t *testing.T) {
 		description string
 		entrypoint  string
 		tty         bool
+		name        string
+		create      bool
+		runtimeName string
 		want        string
 	}{
 		{
 			"Override the entrypoint",
 			"/bin/ohyeah",
 			false,
+			"",
+			false,
+			"",
 			"docker run --rm --interactive --entrypoint /bin/ohyeah --workdir /lope --net host",
 		},
 		{
 			"Allocate a pseudo-TTY",
 			"/bin/ohyeah",
 			true,
+			"",
+			false,
+			"",
 			"docker run --rm --interactive --entrypoint /bin/ohyeah --workdir /lope --net host --tty",
 		},
+		{
+			"Use the podman CLI",
+			"/bin/ohyeah",
+			false,
+			"",
+			false,
+			"podman",
+			"podman run --rm --interactive --entrypoint /bin/ohyeah --workdir /lope --net host",
+		},
+		{
+			"Create a named container without removing it",
+			"/bin/ohyeah",
+			false,
+			"lope-123",
+			true,
+			"",
+			"docker create --name lope-123 --interactive --entrypoint /bin/ohyeah --workdir /lope --net host",
+		},
 	}
 
 	for _, test := range tests {
@@ -297,6 +386,9 @@ func TestDefaultParams(t *testing.T) {
 			l.params = make([]string, 0)
 			l.cfg.entrypoint = test.entrypoint
 			l.cfg.tty = test.tty
+			l.name = test.name
+			l.create = test.create
+			l.cfg.runtimeName = test.runtimeName
 			l.defaultParams()
 
 			got := strings.Join(l.params, " ")
@@ -429,6 +521,8 @@ func TestUserAndGroupParams(t *testing.T) {
 		description string
 		mount       bool
 		os          string
+		runtimeName string
+		euid        int
 		want        string
 	}{
 		{
@@ -436,19 +530,41 @@ func TestUserAndGroupParams(t *testing.T) {
 			false,
 			"",
 			"",
+			1000,
+			"",
 		},
 		{
 			"--users is NOT set if mount is true but os isn't linux",
 			true,
 			"windows",
 			"",
+			1000,
+			"",
 		},
 		{
 			"--users IS set if mount is true",
 			true,
 			"linux",
+			"",
+			1000,
 			fmt.Sprintf("--user="),
 		},
+		{
+			"podman keeps the user id instead",
+			true,
+			"linux",
+			"podman",
+			1000,
+			"--userns=keep-id",
+		},
+		{
+			"podman running as root sets the user instead of keeping the id",
+			true,
+			"linux",
+			"podman",
+			0,
+			"--user=",
+		},
 	}
 
 	for _, test := range tests {
@@ -456,6 +572,9 @@ func TestUserAndGroupParams(t *testing.T) {
 			l.params = make([]string, 0)
 			l.cfg.mount = test.mount
 			l.cfg.os = test.os
+			l.cfg.runtimeName = test.runtimeName
+			geteuid = func() int { return test.euid }
+			defer func() { geteuid = os.Geteuid }()
 			l.addUserAndGroup()
 
 			got := strings.Join(l.params, " ")
@@ -534,13 +653,24 @@ func TestCommandProxy(t *testing.T) {
 			"8000",
 			"8000",
 		},
+		{
+			"A free port is used when no port is set",
+			true,
+			"",
+			"free",
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
+			l.params = make([]string, 0)
+			l.runEnv = nil
 			l.cfg.cmdProxy = test.enabled
 			l.cfg.cmdProxyPort = test.port
-			l.commandProxy()
+			if err := l.commandProxy(); err != nil {
+				t.Fatal(err)
+			}
+			defer l.cleanup()
 
 			got := ""
 			want := test.want
@@ -552,12 +682,47 @@ func TestCommandProxy(t *testing.T) {
 						t.Errorf("got %q want %q", err, want)
 					}
 					got = addr.Port()
-
+					if want == "free" && got != "0" && got != "" {
+						got = "free"
+					}
+				}
+				if strings.HasPrefix(e, "LOPE_PROXY_TOKEN=") {
+					t.Errorf("got %q want the token to not be on the command line", e)
 				}
 			}
 			if got != want {
 				t.Errorf("got %q want %q", got, want)
 			}
+			token := false
+			for _, e := range l.runEnv {
+				token = token || strings.HasPrefix(e, "LOPE_PROXY_TOKEN=")
+			}
+			if token != test.enabled {
+				t.Errorf("got token in the runtime env %v want %v", token, test.enabled)
+			}
+			// The token must never end up in the environment of lope itself
+			if _, ok := os.LookupEnv("LOPE_PROXY_TOKEN"); ok {
+				t.Errorf("got the token in the environment of lope")
+			}
 		})
 	}
 }
+
+func TestImageTag(t *testing.T) {
+	l.cfg.sourceImage = "alpine"
+	l.cfg.addMount = false
+	l.dockerfile = "FROM alpine\nRUN echo hello"
+	first := l.imageTag()
+
+	if first != l.imageTag() {
+		t.Errorf("expected the same tag for the same dockerfile")
+	}
+	if !strings.HasPrefix(first, "lope:") {
+		t.Errorf("got %q wanted prefix: %q", first, "lope:")
+	}
+
+	l.dockerfile = "FROM alpine\nRUN echo world"
+	if first == l.imageTag() {
+		t.Errorf("expected a different tag for a different dockerfile")
+	}
+}
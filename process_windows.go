@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// newProcessGroup is a noop on windows where there are no process groups
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the process itself on windows
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
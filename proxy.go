@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Crazybus/lope/frame"
+	"github.com/creack/pty"
+
+	slashpath "path"
+)
+
+// proxyRule allows the command proxy to run a command on the host. When Args
+// is empty any arguments are allowed, otherwise every argument has to match
+// one of the patterns.
+type proxyRule struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+// parseProxyRule parses the value of the -cmdProxyAllow flag which is either
+// a command or a command and an argument pattern separated by a colon
+func parseProxyRule(value string) proxyRule {
+	parts := strings.SplitN(value, ":", 2)
+	rule := proxyRule{Command: parts[0]}
+	if len(parts) == 2 {
+		rule.Args = []string{parts[1]}
+	}
+	return rule
+}
+
+type proxyAllow struct {
+	command string
+	args    []*regexp.Regexp
+}
+
+// compileProxyRules checks the allowlist of the command proxy. Patterns need
+// to match the whole argument.
+func compileProxyRules(rules []proxyRule) ([]proxyAllow, error) {
+	allow := []proxyAllow{}
+	for _, r := range rules {
+		if r.Command == "" || strings.ContainsAny(r.Command, `/\`) {
+			return nil, fmt.Errorf("command proxy rules need a command name without a path, got %q", r.Command)
+		}
+		a := proxyAllow{command: r.Command}
+		for _, p := range r.Args {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument pattern for %q: %v", r.Command, err)
+			}
+			a.args = append(a.args, re)
+		}
+		allow = append(allow, a)
+	}
+	return allow, nil
+}
+
+// proxyServer runs commands on the host for the container. Every request
+// needs the token of the session and commands are only run when they are on
+// the allowlist.
+type proxyServer struct {
+	token string
+	allow []proxyAllow
+	// mounts map the working directory and paths in the environment of the
+	// client back to the host
+	mounts []mount
+	// env are regexes of the environment variables of the client that are
+	// passed on to the command
+	env []string
+	// audit records every command that was requested
+	audit *auditLog
+	// limits stop the container from overloading the host
+	limits proxyLimits
+	// dirs are the directories files can be copied to and from
+	dirs []transferDir
+}
+
+func newProxyServer(rules []proxyRule) (*proxyServer, error) {
+	allow, err := compileProxyRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyServer{
+		token: randomID() + randomID() + randomID(),
+		allow: allow,
+	}, nil
+}
+
+// allowed reports if a command with these arguments is on the allowlist
+func (p *proxyServer) allowed(command string, args []string) bool {
+	for _, a := range p.allow {
+		if a.command != command {
+			continue
+		}
+		if matchesAll(a.args, args) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAll(patterns []*regexp.Regexp, args []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, arg := range args {
+		matched := false
+		for _, re := range patterns {
+			if re.MatchString(arg) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// authorized checks the bearer token in constant time
+func (p *proxyServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1
+}
+
+// proxyRequest is sent by the client to run a command on the host
+type proxyRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// TTY runs the command in a pseudo terminal with Rows and Cols
+	TTY  bool   `json:"tty"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+	// Dir and Env are the working directory and environment of the client
+	Dir string   `json:"dir"`
+	Env []string `json:"env"`
+}
+
+// proxySignals can be forwarded to proxied commands. The names are sent
+// instead of the numbers because they differ between operating systems.
+var proxySignals = map[string]os.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func (p *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		http.Error(w, "invalid or missing proxy token", http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, filesPath) {
+		p.transfer(w, r)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var msg proxyRequest
+	err = json.Unmarshal(b, &msg)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	entry := auditEntry{
+		Time:    time.Now(),
+		Command: msg.Command,
+		Args:    msg.Args,
+		Dir:     msg.Dir,
+		Exit:    -1,
+	}
+	defer func() {
+		entry.DurationMs = time.Since(entry.Time).Nanoseconds() / int64(time.Millisecond)
+		p.audit.record(entry)
+	}()
+
+	if !p.allowed(msg.Command, msg.Args) {
+		debug(fmt.Sprintf("Command proxy refused: %v %v\n", msg.Command, strings.Join(msg.Args, " ")))
+		http.Error(w, fmt.Sprintf("%q with these arguments is not allowed by the lope command proxy", msg.Command), http.StatusForbidden)
+		return
+	}
+	entry.Allowed = true
+
+	if !p.limits.acquire() {
+		debug(fmt.Sprintf("Command proxy is busy, refused: %v\n", msg.Command))
+		http.Error(w, fmt.Sprintf("the lope command proxy is already running the maximum of %d commands, try again later", p.limits.maxCommands), http.StatusTooManyRequests)
+		return
+	}
+	defer p.limits.release()
+	limits := p.limits.command()
+
+	c := exec.Command(msg.Command, msg.Args...)
+	if dir, ok := hostPath(p.mounts, msg.Dir); ok {
+		c.Dir = dir
+	} else {
+		debug(fmt.Sprintf("Command proxy can't map %q to the host, using the current directory\n", msg.Dir))
+	}
+	entry.HostDir = c.Dir
+	c.Env = append(os.Environ(), p.environment(msg.Env)...)
+	if r.Header.Get("Upgrade") == frame.Upgrade {
+		entry.Exit, entry.OutputBytes = p.attach(w, c, msg, limits)
+		return
+	}
+
+	// Without an upgrade the command has no stdin and the output is streamed
+	// as frames followed by the exit status
+	w.Header().Set("Content-Type", frame.ContentType)
+	w.WriteHeader(http.StatusOK)
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	out := frame.NewWriter(w, flush)
+
+	c.Stdout = limits.writer(out.Stream(frame.Stdout))
+	c.Stderr = limits.writer(out.Stream(frame.Stderr))
+	newProcessGroup(c)
+	err = c.Start()
+	if err == nil {
+		limits.start(c.Process)
+		// When the client goes away the command is killed
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-r.Context().Done():
+				killProcessGroup(c.Process)
+			case <-exited:
+			}
+		}()
+		err = c.Wait()
+		close(exited)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		fmt.Fprintf(out.Stream(frame.Stderr), "lope: failed to run %q on the host: %v\n", msg.Command, err)
+	}
+	stopped(out, msg.Command, limits)
+	entry.Exit, entry.OutputBytes = commandStatus(err), out.Output()
+	out.Frame(frame.Exit, frame.ExitStatus(entry.Exit))
+}
+
+// attach runs a command that is connected to the client in both directions.
+// The HTTP connection is hijacked so that stdin, resize and signal frames can
+// be read while the output is sent. It returns the exit status and the number
+// of bytes of output.
+func (p *proxyServer) attach(w http.ResponseWriter, c *exec.Cmd, msg proxyRequest, limits *commandLimits) (int, int64) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "the connection can't be upgraded", 500)
+		return -1, 0
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return -1, 0
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %v\r\n\r\n", frame.Upgrade)
+	if err := rw.Flush(); err != nil {
+		return -1, 0
+	}
+	out := frame.NewWriter(conn, nil)
+
+	a, err := startAttached(c, msg, out, limits)
+	if err != nil {
+		fmt.Fprintf(out.Stream(frame.Stderr), "lope: failed to run %q on the host: %v\n", msg.Command, err)
+		out.Frame(frame.Exit, frame.ExitStatus(127))
+		return 127, out.Output()
+	}
+	limits.start(c.Process)
+	go a.input(rw.Reader)
+	status := commandStatus(a.wait())
+	stopped(out, msg.Command, limits)
+	out.Frame(frame.Exit, frame.ExitStatus(status))
+	return status, out.Output()
+}
+
+// stopped tells the client when a command was killed for reaching one of the
+// limits of the command proxy
+func stopped(out *frame.Writer, command string, limits *commandLimits) {
+	if reason := limits.done(); reason != "" {
+		fmt.Fprintf(out.Stream(frame.Stderr), "lope: %q was killed on the host because it %v\n", command, reason)
+	}
+}
+
+// attached is a running command of an attached client
+type attached struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// pty is the pseudo terminal of the command when the client has a tty
+	pty *os.File
+	// output is closed once all output of the pty was sent
+	output chan struct{}
+	// exited is closed once the command was reaped and its PID can be reused
+	exited chan struct{}
+}
+
+// startAttached starts the command in its own process group, or in its own
+// session when it gets a terminal, so that it can be killed with everything it
+// started.
+func startAttached(c *exec.Cmd, msg proxyRequest, out *frame.Writer, limits *commandLimits) (*attached, error) {
+	a := &attached{cmd: c, output: make(chan struct{}), exited: make(chan struct{})}
+
+	if msg.TTY {
+		f, err := pty.StartWithSize(c, &pty.Winsize{Rows: msg.Rows, Cols: msg.Cols})
+		if err != nil {
+			return nil, err
+		}
+		a.pty = f
+		a.stdin = f
+		go func() {
+			io.Copy(limits.writer(out.Stream(frame.Stdout)), f)
+			close(a.output)
+		}()
+		return a, nil
+	}
+
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stdout = limits.writer(out.Stream(frame.Stdout))
+	c.Stderr = limits.writer(out.Stream(frame.Stderr))
+	newProcessGroup(c)
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	a.stdin = stdin
+	close(a.output)
+	return a, nil
+}
+
+// input handles the frames sent by the client until the connection closes.
+// When the client goes away before the command exited it is killed.
+func (a *attached) input(r io.Reader) {
+	for {
+		kind, payload, err := frame.Read(r)
+		if err != nil {
+			if !a.done() {
+				killProcessGroup(a.cmd.Process)
+			}
+			return
+		}
+		switch kind {
+		case frame.Stdin:
+			if len(payload) > 0 {
+				a.stdin.Write(payload)
+			} else if a.pty != nil {
+				// End of file is a Ctrl-D on a terminal
+				a.pty.Write([]byte{4})
+			} else {
+				a.stdin.Close()
+			}
+		case frame.Resize:
+			rows, cols, err := frame.ParseSize(payload)
+			if err == nil && a.pty != nil {
+				pty.Setsize(a.pty, &pty.Winsize{Rows: rows, Cols: cols})
+			}
+		case frame.Signal:
+			if sig, ok := proxySignals[string(payload)]; ok && !a.done() {
+				a.cmd.Process.Signal(sig)
+			}
+		}
+	}
+}
+
+// wait waits for the command to exit and for all of its output to be sent
+func (a *attached) wait() error {
+	err := a.cmd.Wait()
+	close(a.exited)
+	if a.pty != nil {
+		// Processes started in the background can keep the terminal open
+		select {
+		case <-a.output:
+		case <-time.After(time.Second):
+		}
+		a.pty.Close()
+	}
+	return err
+}
+
+// done reports if the command exited
+func (a *attached) done() bool {
+	select {
+	case <-a.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// environment returns the variables of the client that are allowed to be
+// passed on. Values that are paths inside of a mount are mapped to the host.
+func (p *proxyServer) environment(env []string) []string {
+	allowed := []string{}
+	for _, e := range env {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		for _, pattern := range p.env {
+			if matched, _ := regexp.MatchString(pattern, pair[0]); matched {
+				if value, ok := hostPath(p.mounts, pair[1]); ok {
+					pair[1] = value
+				}
+				allowed = append(allowed, pair[0]+"="+pair[1])
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// proxyMounts are the mounts the command proxy translates paths with. When
+// the directory is added to the image it is mapped like a bind mount since
+// the files in the image are a copy of it.
+func proxyMounts(cfg *config) []mount {
+	mounts := cfg.mounts()
+	if cfg.addMount {
+		mounts = append(mounts, mount{host: cfg.dir, container: cfg.workDir})
+	}
+	return mounts
+}
+
+// hostPath maps an absolute path in the container to the host using the
+// mount with the longest matching path
+func hostPath(mounts []mount, p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+	p = slashpath.Clean(p)
+
+	best := -1
+	rel := ""
+	for i, m := range mounts {
+		c := slashpath.Clean(m.container)
+		if p != c && !strings.HasPrefix(p, strings.TrimSuffix(c, "/")+"/") {
+			continue
+		}
+		if best == -1 || len(c) > len(slashpath.Clean(mounts[best].container)) {
+			best = i
+			rel = strings.TrimPrefix(strings.TrimPrefix(p, c), "/")
+		}
+	}
+	if best == -1 {
+		return "", false
+	}
+	return filepath.Join(mounts[best].host, filepath.FromSlash(rel)), true
+}
+
+// proxyHost is the address of the host as seen from the container. With
+// --net host on linux the container shares the network of the host. Docker
+// Desktop forwards connections to host.docker.internal to localhost on the
+// host instead.
+func proxyHost(cfg *config) string {
+	if cfg.os == "linux" {
+		return "127.0.0.1"
+	}
+	if cfg.runtimeName == "podman" {
+		return "host.containers.internal"
+	}
+	return "host.docker.internal"
+}
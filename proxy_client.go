@@ -0,0 +1,91 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// proxyClients are the linux builds of the command proxy client from cmdProxy/
+// which are installed in the container for the commands passed with -proxy
+//
+//go:embed cmdProxy/bin
+var proxyClients embed.FS
+
+// proxyBinDir is a directory on the PATH of most images where the client is
+// installed under the names of the proxied commands
+const proxyBinDir = "/usr/local/bin"
+
+// proxyClient returns the client for the architecture of the container. The
+// containers run on the same architecture as the host, also with Docker
+// Desktop.
+func proxyClient(goarch string) ([]byte, error) {
+	b, err := proxyClients.ReadFile("cmdProxy/bin/lope-proxy-linux_" + goarch)
+	if err != nil {
+		return nil, fmt.Errorf("lope was built without the command proxy client for linux/%v, see cmdProxy/bin/README.md", goarch)
+	}
+	return b, nil
+}
+
+// copyCommand is the name the client is installed as for copying files with
+// the directories of -cmdProxyDir
+const copyCommand = "lope-cp"
+
+// allowProxyCommands makes sure the commands passed with -proxy are allowed
+// to run with any arguments and starts the command proxy for them and for
+// copying files
+func (c *config) allowProxyCommands() {
+	if len(c.proxyCommands) == 0 && len(c.cmdProxyDirs) == 0 {
+		return
+	}
+	c.cmdProxy = true
+
+	allowed := make(map[string]bool)
+	for _, r := range c.cmdProxyAllow {
+		allowed[r.Command] = true
+	}
+	for _, name := range c.proxyCommands {
+		if !allowed[name] {
+			c.cmdProxyAllow = append(c.cmdProxyAllow, proxyRule{Command: name})
+			allowed[name] = true
+		}
+	}
+}
+
+// installProxyClient writes the client to the proxy directory and mounts it
+// into the container once for every proxied command. The client runs the
+// command with the name it was called as, or copies files as lope-cp.
+func (l *lope) installProxyClient() error {
+	names := l.cfg.proxyCommands
+	if len(l.cfg.cmdProxyDirs) > 0 {
+		names = append(names[:len(names):len(names)], copyCommand)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	client, err := proxyClient(runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	dir, err := l.proxyDir()
+	if err != nil {
+		return err
+	}
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		return err
+	}
+	file := filepath.Join(bin, "lope-proxy")
+	if err := ioutil.WriteFile(file, client, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		l.params = append(l.params, "-v", file+":"+proxyBinDir+"/"+name+":ro")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// proxyLimits protect the host from commands that run away inside of the
+// container. Zero values are unlimited.
+type proxyLimits struct {
+	// maxCommands is the number of commands that can run at the same time
+	maxCommands int
+	// timeout is how long a command can run before it is killed
+	timeout time.Duration
+	// maxOutput is the number of bytes of output after which a command is
+	// killed
+	maxOutput int64
+
+	mu      sync.Mutex
+	running int
+}
+
+// acquire reserves one of the slots for running commands. It returns false
+// when all of them are taken.
+func (p *proxyLimits) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxCommands > 0 && p.running >= p.maxCommands {
+		return false
+	}
+	p.running++
+	return true
+}
+
+func (p *proxyLimits) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+}
+
+// command returns the limits of a single command
+func (p *proxyLimits) command() *commandLimits {
+	return &commandLimits{timeout: p.timeout, maxOutput: p.maxOutput}
+}
+
+// commandLimits kills the process group of a command once it ran for too long
+// or wrote too much output
+type commandLimits struct {
+	timeout   time.Duration
+	maxOutput int64
+
+	mu      sync.Mutex
+	process *os.Process
+	timer   *time.Timer
+	written int64
+	// reason is why the command was stopped
+	reason string
+}
+
+// start begins the timeout of the command that was started as process
+func (c *commandLimits) start(process *os.Process) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.process = process
+	if c.reason != "" {
+		// The output limit was hit before the command was handed over
+		killProcessGroup(process)
+		return
+	}
+	if c.timeout > 0 {
+		c.timer = time.AfterFunc(c.timeout, func() {
+			c.stop(fmt.Sprintf("ran for longer than %v", c.timeout))
+		})
+	}
+}
+
+// stop kills the command, only the first reason is kept
+func (c *commandLimits) stop(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason != "" {
+		return
+	}
+	c.reason = reason
+	if c.process != nil {
+		killProcessGroup(c.process)
+	}
+}
+
+// done stops the timeout once the command exited. It returns why the command
+// was stopped or an empty string when it wasn't.
+func (c *commandLimits) done() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.reason
+}
+
+// writer counts the output written to w. Output beyond the limit is
+// discarded and stops the command.
+func (c *commandLimits) writer(w io.Writer) io.Writer {
+	if c.maxOutput <= 0 {
+		return w
+	}
+	return &limitedWriter{w: w, c: c}
+}
+
+type limitedWriter struct {
+	w io.Writer
+	c *commandLimits
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	l.c.mu.Lock()
+	left := l.c.maxOutput - l.c.written
+	allowed := int64(len(p))
+	if allowed > left {
+		allowed = left
+	}
+	l.c.written += allowed
+	l.c.mu.Unlock()
+
+	if allowed > 0 {
+		if _, err := l.w.Write(p[:allowed]); err != nil {
+			return 0, err
+		}
+	}
+	if allowed < int64(len(p)) {
+		l.c.stop(fmt.Sprintf("wrote more than %d bytes of output", l.c.maxOutput))
+	}
+	// The rest is dropped quietly so that the command doesn't fail on its
+	// own before it is killed
+	return len(p), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Crazybus/lope/frame"
+)
+
+func TestProxyServerLimits(t *testing.T) {
+	var tests = []struct {
+		description string
+		maxCommands int
+		timeout     time.Duration
+		maxOutput   int64
+		body        string
+		stdout      string
+		stderr      string
+		status      int
+	}{
+		{
+			"Commands are killed after the timeout",
+			0, 100 * time.Millisecond, 0,
+			`{"command": "sh", "args": ["-c", "echo started; sleep 10"]}`,
+			"started\n",
+			"lope: \"sh\" was killed on the host because it ran for longer than 100ms\n",
+			137,
+		},
+		{
+			"Everything the command started is killed with it",
+			0, 100 * time.Millisecond, 0,
+			`{"command": "sh", "args": ["-c", "sleep 10 & sleep 10"]}`,
+			"",
+			"lope: \"sh\" was killed on the host because it ran for longer than 100ms\n",
+			137,
+		},
+		{
+			"Commands are killed once they write too much output",
+			0, 0, 10,
+			`{"command": "yes"}`,
+			"y\ny\ny\ny\ny\n",
+			"lope: \"yes\" was killed on the host because it wrote more than 10 bytes of output\n",
+			137,
+		},
+		{
+			"Commands within the limits are not affected",
+			1, 10 * time.Second, 10,
+			`{"command": "sh", "args": ["-c", "echo hi; exit 2"]}`,
+			"hi\n",
+			"",
+			2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			p, err := newProxyServer([]proxyRule{{Command: "sh"}, {Command: "yes"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.limits.maxCommands = test.maxCommands
+			p.limits.timeout = test.timeout
+			p.limits.maxOutput = test.maxOutput
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			req.Header.Set("Authorization", "Bearer "+p.token)
+			w := httptest.NewRecorder()
+
+			start := time.Now()
+			p.ServeHTTP(w, req)
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("the command took %v, it wasn't killed", took)
+			}
+
+			stdout, stderr, status := readFrames(t, w.Body)
+			if stdout != test.stdout {
+				t.Errorf("got stdout %q want %q", stdout, test.stdout)
+			}
+			if stderr != test.stderr {
+				t.Errorf("got stderr %q want %q", stderr, test.stderr)
+			}
+			if status != test.status {
+				t.Errorf("got status %d want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestProxyServerMaxCommands(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{{Command: "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.limits.maxCommands = 1
+
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"command": "true"}`))
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	// Another command is still running
+	p.limits.acquire()
+	w := request()
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d want %d", w.Code, http.StatusTooManyRequests)
+	}
+	want := "the lope command proxy is already running the maximum of 1 commands, try again later\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+
+	// The slot is free again once it exited
+	p.limits.release()
+	if w := request(); w.Code != http.StatusOK {
+		t.Errorf("got status %d want %d", w.Code, http.StatusOK)
+	}
+	if w := request(); w.Code != http.StatusOK {
+		t.Errorf("got status %d want %d after the previous command exited", w.Code, http.StatusOK)
+	}
+}
+
+// readFrames returns the output and the exit status of a streamed command
+func readFrames(t *testing.T, r io.Reader) (string, string, int) {
+	var stdout, stderr string
+	for {
+		kind, payload, err := frame.Read(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch kind {
+		case frame.Stdout:
+			stdout += string(payload)
+		case frame.Stderr:
+			stderr += string(payload)
+		case frame.Exit:
+			status, _ := frame.ParseExitStatus(payload)
+			return stdout, stderr, status
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Crazybus/lope/frame"
+)
+
+func TestParseProxyRule(t *testing.T) {
+	var tests = []struct {
+		description string
+		value       string
+		want        proxyRule
+	}{
+		{
+			"A command allows any arguments",
+			"make",
+			proxyRule{Command: "make"},
+		},
+		{
+			"A pattern after the colon restricts the arguments",
+			"git:status|log",
+			proxyRule{Command: "git", Args: []string{"status|log"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := parseProxyRule(test.value)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyAllowed(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{
+		{Command: "make"},
+		{Command: "git", Args: []string{"status", "log", "--oneline"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description string
+		command     string
+		args        []string
+		want        bool
+	}{
+		{
+			"Commands without patterns allow any arguments",
+			"make",
+			[]string{"test", "VERBOSE=1"},
+			true,
+		},
+		{
+			"Every argument needs to match a pattern",
+			"git",
+			[]string{"log", "--oneline"},
+			true,
+		},
+		{
+			"Arguments which don't match are refused",
+			"git",
+			[]string{"push", "--force"},
+			false,
+		},
+		{
+			"Patterns need to match the whole argument",
+			"git",
+			[]string{"status; rm -rf /"},
+			false,
+		},
+		{
+			"Commands which aren't on the allowlist are refused",
+			"rm",
+			[]string{},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := p.allowed(test.command, test.args)
+
+			if got != test.want {
+				t.Errorf("got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileProxyRules(t *testing.T) {
+	var tests = []struct {
+		description string
+		rules       []proxyRule
+	}{
+		{
+			"Commands can't be paths",
+			[]proxyRule{{Command: "/bin/sh"}},
+		},
+		{
+			"Patterns need to be valid",
+			[]proxyRule{{Command: "git", Args: []string{"("}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if _, err := compileProxyRules(test.rules); err == nil {
+				t.Errorf("got error %v want an error", err)
+			}
+		})
+	}
+}
+
+func TestProxyServer(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{{Command: "echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description string
+		token       string
+		body        string
+		want        int
+	}{
+		{
+			"Requests without the token are refused",
+			"",
+			`{"command": "echo", "args": ["hi"]}`,
+			http.StatusUnauthorized,
+		},
+		{
+			"Requests with the wrong token are refused",
+			"guess",
+			`{"command": "echo", "args": ["hi"]}`,
+			http.StatusUnauthorized,
+		},
+		{
+			"Commands which aren't allowed are refused",
+			p.token,
+			`{"command": "id"}`,
+			http.StatusForbidden,
+		},
+		{
+			"Allowed commands are run",
+			p.token,
+			`{"command": "echo", "args": ["hi"]}`,
+			http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("got %d want %d", w.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyServerStreams(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{{Command: "sh"}, {Command: "lope-missing-command"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description string
+		body        string
+		stdout      string
+		stderr      string
+		status      int
+	}{
+		{
+			"Stdout and stderr are separate and the exit status is sent last",
+			`{"command": "sh", "args": ["-c", "echo out; echo err >&2; exit 3"]}`,
+			"out\n",
+			"err\n",
+			3,
+		},
+		{
+			"Exit statuses the container runtime uses are passed through",
+			`{"command": "sh", "args": ["-c", "exit 125"]}`,
+			"",
+			"",
+			125,
+		},
+		{
+			"Commands that can't be started exit with 127",
+			`{"command": "lope-missing-command"}`,
+			"",
+			"lope: failed to run \"lope-missing-command\" on the host: exec: \"lope-missing-command\": executable file not found in $PATH\n",
+			127,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			req.Header.Set("Authorization", "Bearer "+p.token)
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			var stdout, stderr string
+			status := -1
+			for status == -1 {
+				kind, payload, err := frame.Read(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch kind {
+				case frame.Stdout:
+					stdout += string(payload)
+				case frame.Stderr:
+					stderr += string(payload)
+				case frame.Exit:
+					status, _ = frame.ParseExitStatus(payload)
+				}
+			}
+
+			if stdout != test.stdout {
+				t.Errorf("got stdout %q want %q", stdout, test.stdout)
+			}
+			if stderr != test.stderr {
+				t.Errorf("got stderr %q want %q", stderr, test.stderr)
+			}
+			if status != test.status {
+				t.Errorf("got status %d want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestProxyServerClientGone(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{{Command: "sh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"command": "sh", "args": ["-c", "sleep 10 & sleep 10"]}`))
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	w := httptest.NewRecorder()
+
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	p.ServeHTTP(w, req)
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("the command took %v, it wasn't killed when the client went away", took)
+	}
+}
+
+func TestProxyServerAttach(t *testing.T) {
+	p, err := newProxyServer([]proxyRule{{Command: "sh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	var tests = []struct {
+		description string
+		request     proxyRequest
+		// input is sent once the command wrote its first output
+		input  [][]byte
+		kinds  []byte
+		stdout string
+		status int
+	}{
+		{
+			"Stdin is forwarded to the command",
+			proxyRequest{Command: "sh", Args: []string{"-c", "echo ready; read line; echo got $line"}},
+			[][]byte{[]byte("hello\n")},
+			[]byte{frame.Stdin},
+			"ready\ngot hello\n",
+			0,
+		},
+		{
+			"Closing stdin ends the input of the command",
+			proxyRequest{Command: "sh", Args: []string{"-c", "echo ready; cat; echo done"}},
+			[][]byte{[]byte("hi\n"), nil},
+			[]byte{frame.Stdin, frame.Stdin},
+			"ready\nhi\ndone\n",
+			0,
+		},
+		{
+			"Signals are forwarded to the command",
+			proxyRequest{Command: "sh", Args: []string{"-c", "trap 'exit 7' TERM; echo ready; while :; do sleep 0.1; done"}},
+			[][]byte{[]byte("SIGTERM")},
+			[]byte{frame.Signal},
+			"ready\n",
+			7,
+		},
+		{
+			"Commands run in a terminal when the client has a tty",
+			proxyRequest{Command: "sh", Args: []string{"-c", "test -t 0 && echo ready"}, TTY: true, Rows: 24, Cols: 80},
+			nil,
+			nil,
+			"ready\r\n",
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			body, _ := json.Marshal(test.request)
+			req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+p.token)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", frame.Upgrade)
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("got %d want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+
+			var stdout string
+			status := -1
+			for status == -1 {
+				kind, payload, err := frame.Read(br)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch kind {
+				case frame.Stdout:
+					if stdout == "" {
+						for i, input := range test.input {
+							frame.Write(conn, test.kinds[i], input)
+						}
+					}
+					stdout += string(payload)
+				case frame.Exit:
+					status, _ = frame.ParseExitStatus(payload)
+				}
+			}
+
+			if stdout != test.stdout {
+				t.Errorf("got stdout %q want %q", stdout, test.stdout)
+			}
+			if status != test.status {
+				t.Errorf("got status %d want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestHostPath(t *testing.T) {
+	mounts := []mount{
+		{host: "/home/user/.kube/", container: "/root/.kube/"},
+		{host: "/home/user/project", container: "/lope"},
+		{host: "/home/user/data", container: "/lope/data"},
+	}
+
+	var tests = []struct {
+		description string
+		path        string
+		want        string
+		ok          bool
+	}{
+		{
+			"The working directory is mapped to the project",
+			"/lope",
+			"/home/user/project",
+			true,
+		},
+		{
+			"Sub directories are mapped too",
+			"/lope/manifests/",
+			"/home/user/project/manifests",
+			true,
+		},
+		{
+			"The mount with the longest path wins",
+			"/lope/data/file",
+			"/home/user/data/file",
+			true,
+		},
+		{
+			"Home directory mounts are mapped",
+			"/root/.kube/config",
+			"/home/user/.kube/config",
+			true,
+		},
+		{
+			"Paths that only share a prefix aren't mapped",
+			"/lopes",
+			"",
+			false,
+		},
+		{
+			"Paths outside of mounts aren't mapped",
+			"/tmp",
+			"",
+			false,
+		},
+		{
+			"Relative paths aren't mapped",
+			"manifests",
+			"",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := hostPath(mounts, test.path)
+
+			if got != test.want || ok != test.ok {
+				t.Errorf("got %q %v want %q %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestProxyEnvironment(t *testing.T) {
+	p := &proxyServer{
+		mounts: []mount{{host: "/home/user/.kube/", container: "/root/.kube/"}},
+		env:    []string{"^KUBECONFIG$", "^AWS_"},
+	}
+
+	got := p.environment([]string{
+		"KUBECONFIG=/root/.kube/config",
+		"AWS_PROFILE=dev",
+		"HOME=/root",
+		"PATH=/usr/bin",
+	})
+	want := []string{
+		"KUBECONFIG=/home/user/.kube/config",
+		"AWS_PROFILE=dev",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestProxyServerDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "manifests"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newProxyServer([]proxyRule{{Command: "pwd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mounts = []mount{{host: dir, container: "/lope"}}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"command": "pwd", "dir": "/lope/manifests"}`))
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	w := httptest.NewRecorder()
+
+	p.ServeHTTP(w, req)
+
+	_, payload, err := frame.Read(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dir, "manifests") + "\n"
+	if string(payload) != want {
+		t.Errorf("got %q want %q", payload, want)
+	}
+}
+
+func TestProxyListenerSocket(t *testing.T) {
+	l := lope{cfg: &config{cmdProxySocket: true}}
+
+	listener, address, err := l.proxyListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := listener.Addr().String()
+	listener.Close()
+
+	if want := "unix:///lope-proxy/proxy.sock"; address != want {
+		t.Errorf("got %q want %q", address, want)
+	}
+	want := []string{"-v", filepath.Dir(socket) + ":/lope-proxy"}
+	if !reflect.DeepEqual(l.params, want) {
+		t.Errorf("got %q want %q", l.params, want)
+	}
+
+	l.cleanup()
+	if _, err := os.Stat(filepath.Dir(socket)); !os.IsNotExist(err) {
+		t.Errorf("got error %v want the socket directory to be removed", err)
+	}
+}
+
+func TestAllowProxyCommands(t *testing.T) {
+	c := &config{
+		proxyCommands: []string{"docker-credential-osxkeychain", "git"},
+		cmdProxyAllow: []proxyRule{{Command: "git", Args: []string{"status"}}},
+	}
+
+	c.allowProxyCommands()
+
+	want := []proxyRule{
+		{Command: "git", Args: []string{"status"}},
+		{Command: "docker-credential-osxkeychain"},
+	}
+	if !reflect.DeepEqual(c.cmdProxyAllow, want) {
+		t.Errorf("got %+v want %+v", c.cmdProxyAllow, want)
+	}
+	if !c.cmdProxy {
+		t.Errorf("got cmdProxy %v want %v", c.cmdProxy, true)
+	}
+}
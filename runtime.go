@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Runtime is the container engine lope uses to build images and run
+// containers. Containers are described with the same parameters that would be
+// passed to `docker run` so that every runtime supports the same options.
+type Runtime interface {
+	// Build builds image from a tar archive of the build context. dockerfile
+	// is the name of the dockerfile inside of the archive.
+	Build(image string, context io.Reader, dockerfile string) (string, error)
+	// Run runs a container attached to stdin/stdout/stderr. Containers started
+	// with --detach are left running in the background instead. env has the
+	// NAME=value pairs for variables that params only pass by name with -e, so
+	// that their values aren't on the command line of the runtime.
+	Run(params []string, env []string) error
+	// ImageID returns the ID of a local image or an error if it doesn't exist
+	ImageID(image string) (string, error)
+	// Create creates a container without starting it. env is the same as for Run.
+	Create(params []string, env []string) error
+	// Start starts a created container attached to stdin/stdout/stderr
+	Start(container string) error
+	Stop(container string) error
+	// Kill sends a signal like SIGTERM to the main process of a container
+	Kill(container string, signal string) error
+	Remove(container string) error
+	RemoveImage(image string) error
+	// CopyTo extracts a tar archive at the root of the container filesystem
+	CopyTo(container string, archive io.Reader) error
+	// CopyFrom writes a tar archive of src inside of the container to w
+	CopyFrom(container string, src string, w io.Writer) error
+}
+
+// runtimeError is returned when the container runtime fails to perform an
+// action. Status is the exit code of the CLI or the HTTP status of the API.
+type runtimeError struct {
+	Action  string
+	Status  int
+	Message string
+}
+
+func (e *runtimeError) Error() string {
+	if e.Status > 0 {
+		return fmt.Sprintf("%v failed (%d): %v", e.Action, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%v failed: %v", e.Action, e.Message)
+}
+
+// newRuntime returns the runtime for the configured CLI. For docker the CLI
+// is used when it is installed and otherwise lope talks to the Docker Engine
+// API on the docker socket directly.
+func newRuntime(cfg *config) (Runtime, error) {
+	switch cfg.runtimeName {
+	case "podman", "nerdctl":
+		if _, err := exec.LookPath(cfg.runtimeName); err != nil {
+			return nil, fmt.Errorf("runtime %q is not installed: %v", cfg.runtimeName, err)
+		}
+		return &cliRuntime{binary: cfg.runtimeName}, nil
+	case "", "docker":
+		if _, err := exec.LookPath("docker"); err == nil {
+			return &cliRuntime{binary: "docker"}, nil
+		}
+		debug(fmt.Sprintf("docker CLI not found, using the API on %q\n", cfg.dockerSocket))
+		return newAPIRuntime(cfg.dockerSocket), nil
+	}
+	return nil, fmt.Errorf("unknown runtime %q, must be one of docker, podman or nerdctl", cfg.runtimeName)
+}
+
+// detached reports if docker run style parameters contain --detach
+func detached(params []string) bool {
+	for _, p := range params {
+		if p == "-d" || p == "--detach" || p == "--detach=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// cliRuntime runs commands with a docker compatible command line client
+type cliRuntime struct {
+	binary string
+}
+
+// command returns the CLI command with env added to the environment of lope
+func (c *cliRuntime) command(args []string, env []string) *exec.Cmd {
+	debug(fmt.Sprintf("Running: %v %v\n", c.binary, strings.Join(args, " ")))
+	cmd := exec.Command(c.binary, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// exec runs the CLI and turns failures into a runtimeError with the output
+func (c *cliRuntime) exec(action string, args []string, env []string, stdin io.Reader, stdout io.Writer) (string, error) {
+	cmd := c.command(args, env)
+
+	var out bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &out
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if err != nil {
+		status := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		}
+		return out.String(), &runtimeError{
+			Action:  action,
+			Status:  status,
+			Message: strings.TrimSpace(out.String()),
+		}
+	}
+	return out.String(), nil
+}
+
+// attach runs the CLI attached to stdin/stdout/stderr. Without a terminal the
+// CLI gets its own process group so that signals only reach the container
+// once, when lope forwards them.
+func (c *cliRuntime) attach(args []string, env []string) error {
+	cmd := c.command(args, env)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		newProcessGroup(cmd)
+	}
+	err := commandExit(cmd.Run())
+	if e, ok := err.(*runtimeError); ok && e.Status == cliFailed {
+		// The CLI failed itself rather than the container and already printed why
+		return &runtimeError{
+			Action:  "run",
+			Status:  -1,
+			Message: fmt.Sprintf("the container runtime failed to run the container (status %d)", cliFailed),
+		}
+	}
+	return err
+}
+
+func (c *cliRuntime) Build(image string, context io.Reader, dockerfile string) (string, error) {
+	out, err := c.exec("build", []string{"build", "-t", image, "-f", dockerfile, "-"}, nil, context, nil)
+	debug(out)
+	return out, err
+}
+
+func (c *cliRuntime) ImageID(image string) (string, error) {
+	out, err := c.exec("image inspect", []string{"image", "inspect", "--format", "{{.Id}}", image}, nil, nil, nil)
+	return strings.TrimSpace(out), err
+}
+
+func (c *cliRuntime) Run(params []string, env []string) error {
+	if detached(params) {
+		_, err := c.exec("run --detach", params[1:], env, nil, nil)
+		return err
+	}
+	return c.attach(params[1:], env)
+}
+
+func (c *cliRuntime) Create(params []string, env []string) error {
+	_, err := c.exec("create", params[1:], env, nil, nil)
+	return err
+}
+
+func (c *cliRuntime) Start(container string) error {
+	return c.attach([]string{"start", "--attach", "--interactive", container}, nil)
+}
+
+func (c *cliRuntime) Stop(container string) error {
+	_, err := c.exec("stop", []string{"stop", container}, nil, nil, nil)
+	return err
+}
+
+func (c *cliRuntime) Remove(container string) error {
+	_, err := c.exec("rm", []string{"rm", "--force", container}, nil, nil, nil)
+	return err
+}
+
+func (c *cliRuntime) Kill(container string, signal string) error {
+	_, err := c.exec("kill", []string{"kill", "--signal", signal, container}, nil, nil, nil)
+	return err
+}
+
+func (c *cliRuntime) RemoveImage(image string) error {
+	_, err := c.exec("image rm", []string{"image", "rm", image}, nil, nil, nil)
+	return err
+}
+
+func (c *cliRuntime) CopyTo(container string, archive io.Reader) error {
+	_, err := c.exec("cp", []string{"cp", "-", container + ":/"}, nil, archive, nil)
+	return err
+}
+
+func (c *cliRuntime) CopyFrom(container string, src string, w io.Writer) error {
+	_, err := c.exec("cp", []string{"cp", container + ":" + src, "-"}, nil, nil, w)
+	return err
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// The oldest API version that supports everything lope needs (Docker 17.06)
+const apiVersion = "v1.30"
+
+// apiRuntime talks to the Docker Engine API over the unix socket so that lope
+// also works on hosts without the docker CLI installed
+type apiRuntime struct {
+	socket string
+	client *http.Client
+}
+
+func newAPIRuntime(socket string) *apiRuntime {
+	a := &apiRuntime{socket: socket}
+	a.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return a.dial(ctx)
+			},
+		},
+	}
+	return a
+}
+
+func (a *apiRuntime) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", a.socket)
+}
+
+func (a *apiRuntime) url(p string, query url.Values) string {
+	u := "http://docker/" + apiVersion + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends a request to the API and converts error responses into a runtimeError
+func (a *apiRuntime) do(action string, method string, p string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, a.url(p, query), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	debug(fmt.Sprintf("API request: %v %v\n", method, req.URL.Path))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, &runtimeError{
+			Action:  action,
+			Status:  -1,
+			Message: fmt.Sprintf("failed to connect to the docker daemon on %q: %v", a.socket, err),
+		}
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(b, &msg); err != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(b))
+		}
+		return nil, &runtimeError{
+			Action:  action,
+			Status:  resp.StatusCode,
+			Message: msg.Message,
+		}
+	}
+	return resp, nil
+}
+
+func (a *apiRuntime) doJSON(action string, method string, p string, query url.Values, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := a.do(action, method, p, query, body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// readProgress reads the stream of JSON messages returned when building or
+// pulling images and returns the output
+func readProgress(action string, r io.Reader) (string, error) {
+	var out bytes.Buffer
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return out.String(), err
+		}
+		if msg.Error != "" {
+			return out.String(), &runtimeError{
+				Action:  action,
+				Status:  -1,
+				Message: msg.Error,
+			}
+		}
+		out.WriteString(msg.Stream)
+		if msg.Status != "" {
+			out.WriteString(msg.Status + "\n")
+		}
+	}
+	return out.String(), nil
+}
+
+func (a *apiRuntime) Build(image string, context io.Reader, dockerfile string) (string, error) {
+	query := url.Values{}
+	query.Set("t", image)
+	query.Set("dockerfile", dockerfile)
+	query.Set("rm", "1")
+	resp, err := a.do("build", "POST", "/build", query, context, "application/x-tar")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	out, err := readProgress("build", resp.Body)
+	debug(out)
+	return out, err
+}
+
+func (a *apiRuntime) ImageID(image string) (string, error) {
+	var inspect struct {
+		ID string `json:"Id"`
+	}
+	err := a.doJSON("image inspect", "GET", "/images/"+image+"/json", nil, nil, &inspect)
+	return inspect.ID, err
+}
+
+func (a *apiRuntime) pull(image string) error {
+	query := url.Values{}
+	name, tag := splitImage(image)
+	query.Set("fromImage", name)
+	query.Set("tag", tag)
+	resp, err := a.do("pull", "POST", "/images/create", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := readProgress("pull", resp.Body)
+	debug(out)
+	return err
+}
+
+// splitImage splits an image reference into the name and the tag or digest
+func splitImage(image string) (string, string) {
+	if i := strings.LastIndex(image, "@"); i != -1 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+// create creates the container, pulling the image first if it doesn't exist yet
+func (a *apiRuntime) create(spec *containerSpec) (string, error) {
+	query := url.Values{}
+	if spec.name != "" {
+		query.Set("name", spec.name)
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := a.doJSON("create", "POST", "/containers/create", query, spec.config, &created)
+	if e, ok := err.(*runtimeError); ok && e.Status == http.StatusNotFound {
+		if err := a.pull(spec.config.Image); err != nil {
+			return "", err
+		}
+		err = a.doJSON("create", "POST", "/containers/create", query, spec.config, &created)
+	}
+	return created.ID, err
+}
+
+func (a *apiRuntime) Run(params []string, env []string) error {
+	spec, err := parseRunParams(params[2:], env)
+	if err != nil {
+		return err
+	}
+	id, err := a.create(spec)
+	if err != nil {
+		return err
+	}
+	if spec.detach {
+		return a.doJSON("start", "POST", "/containers/"+id+"/start", nil, nil, nil)
+	}
+	return a.attach(id, spec.config.Tty, spec.config.OpenStdin, spec.remove)
+}
+
+func (a *apiRuntime) Create(params []string, env []string) error {
+	spec, err := parseRunParams(params[2:], env)
+	if err != nil {
+		return err
+	}
+	_, err = a.create(spec)
+	return err
+}
+
+func (a *apiRuntime) Start(container string) error {
+	var inspect struct {
+		Config struct {
+			Tty       bool
+			OpenStdin bool
+		}
+	}
+	err := a.doJSON("inspect", "GET", "/containers/"+container+"/json", nil, nil, &inspect)
+	if err != nil {
+		return err
+	}
+	return a.attach(container, inspect.Config.Tty, inspect.Config.OpenStdin, false)
+}
+
+// attach starts the container and connects it to stdin/stdout/stderr until it
+// exits. The connection is hijacked from the HTTP request the same way the
+// docker CLI does it.
+func (a *apiRuntime) attach(id string, tty bool, stdin bool, remove bool) error {
+	conn, err := a.dial(context.Background())
+	if err != nil {
+		return &runtimeError{Action: "attach", Status: -1, Message: err.Error()}
+	}
+	defer conn.Close()
+
+	query := url.Values{}
+	query.Set("stream", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	if stdin {
+		query.Set("stdin", "1")
+	}
+	req, err := http.NewRequest("POST", a.url("/containers/"+id+"/attach", query), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		return &runtimeError{Action: "attach", Status: -1, Message: err.Error()}
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return &runtimeError{Action: "attach", Status: -1, Message: err.Error()}
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		return &runtimeError{Action: "attach", Status: resp.StatusCode, Message: resp.Status}
+	}
+
+	if remove {
+		defer a.Remove(id)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if tty && term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err == nil {
+			defer term.Restore(fd, state)
+		}
+	}
+
+	if err := a.doJSON("start", "POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return err
+	}
+
+	if tty {
+		if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+			query := url.Values{}
+			query.Set("h", strconv.Itoa(h))
+			query.Set("w", strconv.Itoa(w))
+			a.doJSON("resize", "POST", "/containers/"+id+"/resize", query, nil, nil)
+		}
+	}
+
+	if stdin {
+		go func() {
+			io.Copy(conn, os.Stdin)
+			if c, ok := conn.(*net.UnixConn); ok {
+				c.CloseWrite()
+			}
+		}()
+	}
+
+	if tty {
+		io.Copy(os.Stdout, br)
+	} else {
+		demux(br, os.Stdout, os.Stderr)
+	}
+
+	var wait struct {
+		StatusCode int
+	}
+	if err := a.doJSON("wait", "POST", "/containers/"+id+"/wait", nil, nil, &wait); err != nil {
+		return err
+	}
+	if wait.StatusCode != 0 {
+		return &runtimeError{
+			Action:  "run",
+			Status:  wait.StatusCode,
+			Message: fmt.Sprintf("container exited with status %d", wait.StatusCode),
+		}
+	}
+	return nil
+}
+
+// demux splits the multiplexed stdout/stderr stream of a container without a
+// tty. Each frame has an 8 byte header with the stream type and payload size.
+func demux(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *apiRuntime) Stop(container string) error {
+	return a.doJSON("stop", "POST", "/containers/"+container+"/stop", nil, nil, nil)
+}
+
+func (a *apiRuntime) Remove(container string) error {
+	query := url.Values{}
+	query.Set("force", "1")
+	return a.doJSON("rm", "DELETE", "/containers/"+container, query, nil, nil)
+}
+
+func (a *apiRuntime) Kill(container string, signal string) error {
+	query := url.Values{}
+	query.Set("signal", signal)
+	return a.doJSON("kill", "POST", "/containers/"+container+"/kill", query, nil, nil)
+}
+
+func (a *apiRuntime) RemoveImage(image string) error {
+	return a.doJSON("image rm", "DELETE", "/images/"+image, nil, nil, nil)
+}
+
+func (a *apiRuntime) CopyTo(container string, archive io.Reader) error {
+	query := url.Values{}
+	query.Set("path", "/")
+	resp, err := a.do("cp", "PUT", "/containers/"+container+"/archive", query, archive, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (a *apiRuntime) CopyFrom(container string, src string, w io.Writer) error {
+	query := url.Values{}
+	query.Set("path", src)
+	resp, err := a.do("cp", "GET", "/containers/"+container+"/archive", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort"`
+}
+
+type hostConfig struct {
+	AutoRemove   bool                     `json:"AutoRemove,omitempty"`
+	Binds        []string                 `json:"Binds,omitempty"`
+	CapAdd       []string                 `json:"CapAdd,omitempty"`
+	ExtraHosts   []string                 `json:"ExtraHosts,omitempty"`
+	NetworkMode  string                   `json:"NetworkMode,omitempty"`
+	PortBindings map[string][]portBinding `json:"PortBindings,omitempty"`
+	Privileged   bool                     `json:"Privileged,omitempty"`
+}
+
+type containerConfig struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Hostname     string              `json:"Hostname,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	User         string              `json:"User,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Tty          bool                `json:"Tty"`
+	OpenStdin    bool                `json:"OpenStdin"`
+	StdinOnce    bool                `json:"StdinOnce"`
+	AttachStdin  bool                `json:"AttachStdin"`
+	AttachStdout bool                `json:"AttachStdout"`
+	AttachStderr bool                `json:"AttachStderr"`
+	HostConfig   hostConfig          `json:"HostConfig"`
+}
+
+// containerSpec is the API representation of docker run parameters
+type containerSpec struct {
+	name   string
+	detach bool
+	remove bool
+	config containerConfig
+}
+
+// lookupEnv returns the value of name in env, which overrides the environment
+// of lope
+func lookupEnv(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], name+"=") {
+			return env[i][len(name)+1:], true
+		}
+	}
+	return os.LookupEnv(name)
+}
+
+// parseRunParams converts the parameters that lope generates for docker run
+// (without the leading "docker run") into an API request. Only the subset of
+// flags that lope generates and the most common extra arguments are supported.
+// Variables passed by name with -e get their value from env or else from the
+// environment of lope, like the docker CLI does.
+func parseRunParams(args []string, env []string) (*containerSpec, error) {
+	spec := &containerSpec{}
+	c := &spec.config
+	remove := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			c.Image = arg
+			c.Cmd = args[i+1:]
+			break
+		}
+
+		name := arg
+		value := ""
+		hasValue := false
+		if j := strings.Index(arg, "="); j != -1 {
+			name = arg[:j]
+			value = arg[j+1:]
+			hasValue = true
+		}
+
+		switch name {
+		case "--rm":
+			remove = true
+			continue
+		case "-i", "--interactive":
+			c.OpenStdin = true
+			continue
+		case "-t", "--tty":
+			c.Tty = true
+			continue
+		case "-d", "--detach":
+			spec.detach = true
+			continue
+		case "--privileged":
+			c.HostConfig.Privileged = true
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing value for docker run argument %q", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "--name":
+			spec.name = value
+		case "--entrypoint":
+			c.Entrypoint = []string{value}
+		case "-w", "--workdir":
+			c.WorkingDir = value
+		case "--net", "--network":
+			c.HostConfig.NetworkMode = value
+		case "-e", "--env":
+			if !strings.Contains(value, "=") {
+				v, ok := lookupEnv(env, value)
+				if !ok {
+					continue
+				}
+				value = value + "=" + v
+			}
+			c.Env = append(c.Env, value)
+		case "-v", "--volume":
+			c.HostConfig.Binds = append(c.HostConfig.Binds, value)
+		case "-u", "--user":
+			c.User = value
+		case "--add-host":
+			c.HostConfig.ExtraHosts = append(c.HostConfig.ExtraHosts, value)
+		case "-h", "--hostname":
+			c.Hostname = value
+		case "--cap-add":
+			c.HostConfig.CapAdd = append(c.HostConfig.CapAdd, value)
+		case "-l", "--label":
+			if c.Labels == nil {
+				c.Labels = make(map[string]string)
+			}
+			kv := strings.SplitN(value, "=", 2)
+			c.Labels[kv[0]] = ""
+			if len(kv) == 2 {
+				c.Labels[kv[0]] = kv[1]
+			}
+		case "-p", "--publish":
+			port, binding := parsePort(value)
+			if c.ExposedPorts == nil {
+				c.ExposedPorts = make(map[string]struct{})
+				c.HostConfig.PortBindings = make(map[string][]portBinding)
+			}
+			c.ExposedPorts[port] = struct{}{}
+			c.HostConfig.PortBindings[port] = append(c.HostConfig.PortBindings[port], binding)
+		default:
+			return nil, fmt.Errorf("docker run argument %q is not supported by the docker API runtime", name)
+		}
+	}
+
+	if c.Image == "" {
+		return nil, fmt.Errorf("no image found in docker run arguments")
+	}
+
+	c.AttachStdout = !spec.detach
+	c.AttachStderr = !spec.detach
+	c.AttachStdin = c.OpenStdin && !spec.detach
+	c.StdinOnce = c.AttachStdin
+	// Detached containers are removed by the daemon, attached ones are removed
+	// by lope after it has collected the exit code
+	c.HostConfig.AutoRemove = remove && spec.detach
+	spec.remove = remove && !spec.detach
+	return spec, nil
+}
+
+// parsePort converts a [ip:]hostPort:containerPort[/protocol] publish argument
+func parsePort(value string) (string, portBinding) {
+	proto := "tcp"
+	if i := strings.Index(value, "/"); i != -1 {
+		proto = value[i+1:]
+		value = value[:i]
+	}
+	parts := strings.Split(value, ":")
+	container := parts[len(parts)-1] + "/" + proto
+	binding := portBinding{}
+	switch len(parts) {
+	case 2:
+		binding.HostPort = parts[0]
+	case 3:
+		binding.HostIP = parts[0]
+		binding.HostPort = parts[1]
+	}
+	return container, binding
+}
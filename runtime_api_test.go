@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRunParams(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		params      string
+		env         []string
+		want        containerSpec
+	}{
+		{
+			"Parse the default lope parameters",
+			"--rm --interactive --entrypoint /bin/sh --workdir /lope --net host --tty -v /home/lope:/lope -e LOPE_TEST=1 --user=1000:999 alpine -c ls",
+			nil,
+			containerSpec{
+				remove: true,
+				config: containerConfig{
+					Image:        "alpine",
+					Cmd:          []string{"-c", "ls"},
+					Entrypoint:   []string{"/bin/sh"},
+					Env:          []string{"LOPE_TEST=1"},
+					User:         "1000:999",
+					WorkingDir:   "/lope",
+					Tty:          true,
+					OpenStdin:    true,
+					StdinOnce:    true,
+					AttachStdin:  true,
+					AttachStdout: true,
+					AttachStderr: true,
+					HostConfig: hostConfig{
+						Binds:       []string{"/home/lope:/lope"},
+						NetworkMode: "host",
+					},
+				},
+			},
+		},
+		{
+			"Detached containers are removed by the daemon",
+			"--rm --name lope-sshd -d -p 127.0.0.1:2244:22 uber/ssh-agent-forward:latest",
+			nil,
+			containerSpec{
+				name:   "lope-sshd",
+				detach: true,
+				config: containerConfig{
+					Image:        "uber/ssh-agent-forward:latest",
+					Cmd:          []string{},
+					ExposedPorts: map[string]struct{}{"22/tcp": {}},
+					HostConfig: hostConfig{
+						AutoRemove: true,
+						PortBindings: map[string][]portBinding{
+							"22/tcp": {{HostIP: "127.0.0.1", HostPort: "2244"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			"Variables passed by name get their value from env",
+			"-e LOPE_PROXY_TOKEN alpine",
+			[]string{"LOPE_PROXY_TOKEN=secret"},
+			containerSpec{
+				config: containerConfig{
+					Image:        "alpine",
+					Cmd:          []string{},
+					Env:          []string{"LOPE_PROXY_TOKEN=secret"},
+					AttachStdout: true,
+					AttachStderr: true,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseRunParams(strings.Split(test.params, " "), test.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRunParamsUnsupported(t *testing.T) {
+	_, err := parseRunParams([]string{"--ulimit", "nofile=10", "alpine"}, nil)
+	if err == nil {
+		t.Errorf("expected an error for an unsupported argument")
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+
+	var tests = []struct {
+		image string
+		name  string
+		tag   string
+	}{
+		{"alpine", "alpine", "latest"},
+		{"alpine:3.7", "alpine", "3.7"},
+		{"localhost:5000/lope", "localhost:5000/lope", "latest"},
+		{"localhost:5000/lope:1", "localhost:5000/lope", "1"},
+		{"alpine@sha256:123", "alpine", "sha256:123"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			name, tag := splitImage(test.image)
+			if name != test.name || tag != test.tag {
+				t.Errorf("got %q %q want %q %q", name, tag, test.name, test.tag)
+			}
+		})
+	}
+}
+
+func TestDemux(t *testing.T) {
+	in := []byte{
+		1, 0, 0, 0, 0, 0, 0, 3, 'o', 'u', 't',
+		2, 0, 0, 0, 0, 0, 0, 3, 'e', 'r', 'r',
+	}
+	var stdout, stderr bytes.Buffer
+	if err := demux(bytes.NewReader(in), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out" || stderr.String() != "err" {
+		t.Errorf("got %q %q want %q %q", stdout.String(), stderr.String(), "out", "err")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeRuntime records the calls lope makes instead of running containers
+type fakeRuntime struct {
+	images []string
+	calls  []string
+	// env is the env of the last container that was run or created
+	env []string
+	// failRun makes the nth container that is run exit with status 3
+	failRun int
+	runs    int
+}
+
+// exit returns the error of a container that was run
+func (f *fakeRuntime) exit() error {
+	f.runs++
+	if f.runs == f.failRun {
+		return &runtimeError{Action: "run", Status: 3, Message: "container exited with status 3"}
+	}
+	return nil
+}
+
+func (f *fakeRuntime) call(args ...string) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+}
+
+func (f *fakeRuntime) Build(image string, context io.Reader, dockerfile string) (string, error) {
+	f.call("build", image)
+	f.images = append(f.images, image)
+	return "", nil
+}
+
+func (f *fakeRuntime) ImageID(image string) (string, error) {
+	for _, i := range f.images {
+		if i == image {
+			return "sha256:" + image, nil
+		}
+	}
+	return "", &runtimeError{Action: "image inspect", Status: 1, Message: "No such image"}
+}
+
+func (f *fakeRuntime) Run(params []string, env []string) error {
+	f.call("run")
+	f.env = env
+	return f.exit()
+}
+
+func (f *fakeRuntime) Create(params []string, env []string) error {
+	f.call("create")
+	f.env = env
+	return nil
+}
+
+func (f *fakeRuntime) Start(container string) error {
+	f.call("start", container)
+	return f.exit()
+}
+
+func (f *fakeRuntime) Stop(container string) error {
+	f.call("stop", container)
+	return nil
+}
+
+func (f *fakeRuntime) Remove(container string) error {
+	f.call("rm", container)
+	return nil
+}
+
+func (f *fakeRuntime) Kill(container string, signal string) error {
+	f.call("kill", container, signal)
+	return nil
+}
+
+func (f *fakeRuntime) RemoveImage(image string) error {
+	f.call("image rm", image)
+	return nil
+}
+
+func (f *fakeRuntime) CopyTo(container string, archive io.Reader) error {
+	f.call("cp to", container)
+	return nil
+}
+
+func (f *fakeRuntime) CopyFrom(container string, src string, w io.Writer) error {
+	f.call("cp from", container, src)
+	return nil
+}
+
+func TestPrepareSkipsBuild(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		rebuild     bool
+		want        string
+	}{
+		{
+			"The image is only built once",
+			false,
+			"build",
+		},
+		{
+			"The image is always built with rebuild",
+			true,
+			"build,build",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rt := &fakeRuntime{}
+			cfg := &config{
+				containerRuntime: rt,
+				image:            "lope",
+				instructions:     []string{"RUN echo hello"},
+				rebuild:          test.rebuild,
+				sourceImage:      "alpine",
+			}
+
+			for i := 0; i < 2; i++ {
+				c := *cfg
+				l := lope{cfg: &c}
+				if _, err := l.prepare(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			builds := []string{}
+			for _, call := range rt.calls {
+				builds = append(builds, strings.Fields(call)[0])
+			}
+			got := strings.Join(builds, ",")
+			if got != test.want {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
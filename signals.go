@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// stopSignals are forwarded to the container instead of stopping lope
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// exit is replaced in tests
+var exit = os.Exit
+
+// stopGracePeriod is how long the container gets to exit after a signal was
+// forwarded before it is removed forcefully
+var stopGracePeriod = 10 * time.Second
+
+// handleSignals forwards the signals that would stop lope to the container so
+// that lope can still remove everything it started once the container exits.
+// A second signal removes the container right away. The returned function
+// stops handling signals and must be called once the container has exited.
+func (l *lope) handleSignals() func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, stopSignals...)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			l.interrupt(sig, sigs, done)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// interrupt stops the container after lope received sig. When the container
+// hasn't been started yet lope stops before starting it instead.
+func (l *lope) interrupt(sig os.Signal, sigs <-chan os.Signal, done <-chan struct{}) {
+	l.mu.Lock()
+	l.interrupted = sig
+	started := l.started
+	l.mu.Unlock()
+
+	if !started {
+		fmt.Fprintf(os.Stderr, "lope: received %v, stopping before the container is started\n", signalName(sig))
+		select {
+		case <-done:
+		case sig := <-sigs:
+			// Don't wait for the build to finish when asked twice, but still
+			// remove everything that was set up for the container
+			l.cleanup()
+			if l.cfg.exitCleanup != nil {
+				l.cfg.exitCleanup()
+			}
+			exit(128 + signalNumber(sig))
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "lope: received %v, stopping the container\n", signalName(sig))
+	rt := l.cfg.containerRuntime
+	if !receivedByRuntime(rt, sig) {
+		if err := rt.Kill(l.name, signalName(sig)); err != nil {
+			// The container isn't running (yet) so there is nothing to wait for
+			debug(fmt.Sprintf("Failed to forward %v to the container: %v\n", signalName(sig), err))
+			rt.Remove(l.name)
+		}
+	}
+
+	select {
+	case <-done:
+		return
+	case <-sigs:
+	case <-time.After(stopGracePeriod):
+		fmt.Fprintf(os.Stderr, "lope: the container didn't stop within %v, removing it\n", stopGracePeriod)
+	}
+	rt.Remove(l.name)
+}
+
+// start marks the container as started, unless lope was interrupted already
+func (l *lope) start() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interrupted != nil {
+		return &exitError{
+			Code: 128 + signalNumber(l.interrupted),
+			Err:  fmt.Errorf("interrupted by %v", signalName(l.interrupted)),
+		}
+	}
+	l.started = true
+	return nil
+}
+
+// pipelineSignals stops a pipeline between stages. Signals during a stage are
+// handled by the stage itself, the pipeline only doesn't start the next one.
+func pipelineSignals() (func() error, func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, stopSignals...)
+
+	interrupted := func() error {
+		select {
+		case sig := <-sigs:
+			return &exitError{
+				Code: 128 + signalNumber(sig),
+				Err:  fmt.Errorf("interrupted by %v", signalName(sig)),
+			}
+		default:
+			return nil
+		}
+	}
+	return interrupted, func() {
+		signal.Stop(sigs)
+	}
+}
+
+// receivedByRuntime reports if the runtime already got sig itself. The CLI of
+// the runtime is in the foreground process group of the terminal so it gets
+// Ctrl-C from the terminal too and forwards it to the container on its own.
+func receivedByRuntime(rt Runtime, sig os.Signal) bool {
+	_, cli := rt.(*cliRuntime)
+	return cli && sig == os.Interrupt && term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// signalName returns the name of a signal the way docker kill expects it
+func signalName(sig os.Signal) string {
+	switch sig {
+	case os.Interrupt:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
+
+func signalNumber(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return int(s)
+	}
+	return 1
+}
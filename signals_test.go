@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterrupt(t *testing.T) {
+	stopGracePeriod = 10 * time.Millisecond
+
+	var tests = []struct {
+		description string
+		started     bool
+		exited      bool
+		want        []string
+	}{
+		{
+			"Nothing is stopped before the container is started",
+			false,
+			true,
+			nil,
+		},
+		{
+			"The signal is forwarded to the container",
+			true,
+			true,
+			[]string{"kill lope-123 SIGTERM"},
+		},
+		{
+			"The container is removed after the grace period",
+			true,
+			false,
+			[]string{"kill lope-123 SIGTERM", "rm lope-123"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rt := &fakeRuntime{}
+			l := lope{
+				cfg:     &config{containerRuntime: rt},
+				name:    "lope-123",
+				started: test.started,
+			}
+			done := make(chan struct{})
+			if test.exited {
+				close(done)
+			}
+
+			l.interrupt(syscall.SIGTERM, make(chan os.Signal), done)
+
+			if !reflect.DeepEqual(rt.calls, test.want) {
+				t.Errorf("got %q want %q", rt.calls, test.want)
+			}
+		})
+	}
+}
+
+func TestStartAfterInterrupt(t *testing.T) {
+	l := lope{interrupted: syscall.SIGTERM}
+
+	err := l.start()
+
+	if got := exitCode(err); got != 143 {
+		t.Errorf("got %d want %d", got, 143)
+	}
+	if l.started {
+		t.Errorf("got started %v want %v", l.started, false)
+	}
+}
+
+func TestInterruptTwice(t *testing.T) {
+	code := 0
+	exit = func(c int) { code = c }
+	defer func() { exit = os.Exit }()
+
+	ran := []string{}
+	l := lope{
+		cfg: &config{
+			containerRuntime: &fakeRuntime{},
+			exitCleanup:      func() { ran = append(ran, "pipeline") },
+		},
+	}
+	l.addCleanup(func() { ran = append(ran, "proxy") })
+	sigs := make(chan os.Signal, 1)
+	sigs <- os.Interrupt
+
+	l.interrupt(syscall.SIGTERM, sigs, make(chan struct{}))
+
+	if code != 130 {
+		t.Errorf("got exit code %d want %d", code, 130)
+	}
+	want := []string{"proxy", "pipeline"}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("got cleanups %q want %q", ran, want)
+	}
+}
+
+func TestPipelineSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can't be sent on windows")
+	}
+	interrupted, stop := pipelineSignals()
+	defer stop()
+
+	if err := interrupted(); err != nil {
+		t.Fatalf("got %v want no interruption without a signal", err)
+	}
+
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(syscall.SIGTERM)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		err = interrupted()
+	}
+	if got := exitCode(err); got != 143 {
+		t.Errorf("got %d want %d", got, 143)
+	}
+}
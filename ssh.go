@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentSocket is where the socket of the ssh agent is mounted in the
+// container
+const sshAgentSocket = "/ssh-agent/ssh-agent.sock"
+
+// sshForward makes the ssh agent of the host available in the container. On
+// linux the socket of the agent is mounted directly. Docker Desktop only
+// shares some directories of the host with its VM and the socket of the agent
+// usually isn't in one of them, so lope relays the connections through a
+// socket in its own temporary directory instead. When only some keys are
+// forwarded or signatures need to be confirmed lope answers the requests of
+// the container itself. Every step is checked before the container starts so
+// that it doesn't run with an agent that doesn't work.
+func (l *lope) sshForward() error {
+	if !l.cfg.ssh {
+		return nil
+	}
+
+	authSock := os.Getenv("SSH_AUTH_SOCK")
+	if authSock == "" {
+		return errors.New("SSH_AUTH_SOCK is not set, start an agent with 'eval $(ssh-agent)' and add your keys with ssh-add")
+	}
+	if _, err := l.agentReady(authSock); err != nil {
+		return fmt.Errorf("the ssh agent at %q doesn't answer, is it still running? %v", authSock, err)
+	}
+
+	filtered := len(l.cfg.sshKeys) > 0 || l.cfg.sshConfirm
+	if l.cfg.os == "linux" && !filtered {
+		l.sshAgent = authSock
+		return nil
+	}
+
+	handle := func(conn net.Conn) {
+		relay(conn, authSock)
+	}
+	if filtered {
+		filter, err := compileSSHKeys(l.cfg.sshKeys)
+		if err != nil {
+			return err
+		}
+		var confirm func(string) bool
+		if l.cfg.sshConfirm {
+			confirm = confirmSignature
+		}
+		handle = func(conn net.Conn) {
+			serveFiltered(conn, authSock, filter, confirm)
+		}
+	}
+
+	socket, err := l.relayAgent(handle)
+	if err != nil {
+		return fmt.Errorf("failed to relay the ssh agent: %v", err)
+	}
+	keys, err := l.agentReady(socket)
+	if err != nil {
+		return fmt.Errorf("the relay of the ssh agent at %q doesn't answer: %v", socket, err)
+	}
+	if keys == 0 && len(l.cfg.sshKeys) > 0 {
+		fmt.Fprintln(os.Stderr, "lope: none of the keys of the ssh agent match -sshKey, check the fingerprints with 'ssh-add -l'")
+	}
+	l.sshAgent = socket
+	return nil
+}
+
+// agentReady waits until the agent at socket lists its keys. It returns the
+// number of keys.
+func (l *lope) agentReady(socket string) (int, error) {
+	keys := 0
+	err := waitFor(l.cfg.sshTimeout, func() error {
+		conn, err := net.DialTimeout("unix", socket, time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		list, err := agent.NewClient(conn).List()
+		keys = len(list)
+		return err
+	})
+	return keys, err
+}
+
+// relayAgent listens on a new socket for the clients of the ssh agent in the
+// container and passes their connections to handle. It returns the path of
+// the new socket.
+func (l *lope) relayAgent(handle func(net.Conn)) (string, error) {
+	dir, err := ioutil.TempDir("", "lope-ssh-agent")
+	if err != nil {
+		return "", err
+	}
+	l.addCleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	socket := filepath.Join(dir, "ssh-agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	l.addCleanup(func() {
+		listener.Close()
+	})
+	debug(fmt.Sprintf("Relaying the ssh agent through %q\n", socket))
+
+	go serveAgent(listener, handle)
+	return socket, nil
+}
+
+// serveAgent handles every connection to the forwarded agent until the
+// listener is closed
+func serveAgent(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// relay copies the agent protocol between a client and the agent in both
+// directions
+func relay(conn net.Conn, agent string) {
+	defer conn.Close()
+	upstream, err := net.Dial("unix", agent)
+	if err != nil {
+		debug(fmt.Sprintf("Failed to connect to the ssh agent: %v\n", err))
+		return
+	}
+	defer upstream.Close()
+
+	// Whichever side closes first closes the other one too
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
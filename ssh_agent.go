@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// errNotForwarded is returned for requests the container isn't allowed to make
+var errNotForwarded = errors.New("refused by lope")
+
+// sshKeyFilter selects the keys of the agent that are forwarded. Keys match
+// when their fingerprint is one of the fingerprints or their comment matches
+// one of the patterns.
+type sshKeyFilter struct {
+	fingerprints []string
+	comments     []*regexp.Regexp
+}
+
+// compileSSHKeys checks the values of -sshKey which are fingerprints like
+// SHA256:... or MD5:... or regexes of key comments
+func compileSSHKeys(keys []string) (*sshKeyFilter, error) {
+	f := &sshKeyFilter{}
+	for _, k := range keys {
+		if strings.HasPrefix(k, "SHA256:") || strings.HasPrefix(k, "MD5:") {
+			f.fingerprints = append(f.fingerprints, k)
+			continue
+		}
+		re, err := regexp.Compile(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh key pattern %q: %v", k, err)
+		}
+		f.comments = append(f.comments, re)
+	}
+	return f, nil
+}
+
+// matches reports if a key is forwarded. Without any filters every key is.
+func (f *sshKeyFilter) matches(key ssh.PublicKey, comment string) bool {
+	if len(f.fingerprints) == 0 && len(f.comments) == 0 {
+		return true
+	}
+	for _, fp := range f.fingerprints {
+		if fp == ssh.FingerprintSHA256(key) || fp == "MD5:"+ssh.FingerprintLegacyMD5(key) {
+			return true
+		}
+	}
+	for _, re := range f.comments {
+		if re.MatchString(comment) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredAgent only shows the selected keys of the agent of the host to the
+// container. Signing can require a confirmation on the host. Changing the
+// keys of the agent is not allowed.
+type filteredAgent struct {
+	upstream agent.ExtendedAgent
+	filter   *sshKeyFilter
+	// confirm asks if a signature is allowed, nil doesn't ask
+	confirm func(prompt string) bool
+}
+
+func (a *filteredAgent) List() ([]*agent.Key, error) {
+	keys, err := a.upstream.List()
+	if err != nil {
+		return nil, err
+	}
+	filtered := []*agent.Key{}
+	for _, k := range keys {
+		if a.filter.matches(k, k.Comment) {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered, nil
+}
+
+// allowed returns an error when the key isn't forwarded or the signature
+// wasn't confirmed
+func (a *filteredAgent) allowed(key ssh.PublicKey) error {
+	keys, err := a.List()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if string(k.Marshal()) != string(key.Marshal()) {
+			continue
+		}
+		prompt := fmt.Sprintf("Allow the container to use the ssh key %q (%v)?", k.Comment, ssh.FingerprintSHA256(key))
+		if a.confirm != nil && !a.confirm(prompt) {
+			return errNotForwarded
+		}
+		return nil
+	}
+	return errNotForwarded
+}
+
+func (a *filteredAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if err := a.allowed(key); err != nil {
+		return nil, err
+	}
+	return a.upstream.Sign(key, data)
+}
+
+func (a *filteredAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := a.allowed(key); err != nil {
+		return nil, err
+	}
+	return a.upstream.SignWithFlags(key, data, flags)
+}
+
+func (a *filteredAgent) Add(key agent.AddedKey) error   { return errNotForwarded }
+func (a *filteredAgent) Remove(key ssh.PublicKey) error { return errNotForwarded }
+func (a *filteredAgent) RemoveAll() error               { return errNotForwarded }
+func (a *filteredAgent) Lock(passphrase []byte) error   { return errNotForwarded }
+func (a *filteredAgent) Unlock(passphrase []byte) error { return errNotForwarded }
+func (a *filteredAgent) Signers() ([]ssh.Signer, error) { return nil, errNotForwarded }
+func (a *filteredAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// serveFiltered answers the requests of a client with a filtered view of the
+// agent at socket
+func serveFiltered(conn net.Conn, socket string, filter *sshKeyFilter, confirm func(string) bool) {
+	defer conn.Close()
+	upstream, err := net.Dial("unix", socket)
+	if err != nil {
+		debug(fmt.Sprintf("Failed to connect to the ssh agent: %v\n", err))
+		return
+	}
+	defer upstream.Close()
+
+	agent.ServeAgent(&filteredAgent{
+		upstream: agent.NewClient(upstream),
+		filter:   filter,
+		confirm:  confirm,
+	}, conn)
+}
+
+// confirmMu makes sure only one confirmation is asked for at a time
+var confirmMu sync.Mutex
+
+// checkConfirm reports if signatures can be confirmed. The container is
+// attached to stdin, so when stdin is a terminal the answer typed into it
+// could go to the container instead of lope and SSH_ASKPASS is needed.
+func checkConfirm(askpass string, terminal bool) error {
+	if askpass == "" && terminal {
+		return errors.New("-sshConfirm needs SSH_ASKPASS to ask for confirmations when lope is run in a terminal, the container reads the terminal too")
+	}
+	return nil
+}
+
+// confirmSignature asks on the host if a signature is allowed. It uses the
+// program in SSH_ASKPASS like ssh-add -c does, and otherwise the terminal
+// when the container isn't attached to it.
+func confirmSignature(prompt string) bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+
+	if askpass := os.Getenv("SSH_ASKPASS"); askpass != "" {
+		cmd := exec.Command(askpass, prompt)
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+		return cmd.Run() == nil
+	}
+	if err := checkConfirm("", term.IsTerminal(int(os.Stdin.Fd()))); err != nil {
+		debug(fmt.Sprintf("Can't ask for a confirmation of the ssh key: %v\n", err))
+		return false
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		debug(fmt.Sprintf("Can't ask for a confirmation of the ssh key: %v\n", err))
+		return false
+	}
+	defer tty.Close()
+	// The terminal can be in raw mode while the container is attached
+	fmt.Fprintf(tty, "\r\nlope: %v [y/N] ", prompt)
+	answer := readAnswer(bufio.NewReader(tty))
+	fmt.Fprint(tty, "\r\n")
+	return answer == "y" || answer == "yes"
+}
+
+// readAnswer reads a line that ends with enter, which is a carriage return
+// in raw mode and a newline otherwise
+func readAnswer(r io.ByteReader) string {
+	var answer []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b == '\r' || b == '\n' {
+			return strings.ToLower(strings.TrimSpace(string(answer)))
+		}
+		answer = append(answer, b)
+	}
+}
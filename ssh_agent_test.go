@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testAgent starts an agent with a work and a personal key. It returns the
+// socket of the agent and the public keys.
+func testAgent(t *testing.T, dir string) (string, map[string]ssh.PublicKey) {
+	keyring := agent.NewKeyring()
+	keys := make(map[string]ssh.PublicKey)
+	for _, comment := range []string{"work", "personal"} {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring.Add(agent.AddedKey{PrivateKey: private, Comment: comment})
+		signer, _ := ssh.NewSignerFromKey(private)
+		keys[comment] = signer.PublicKey()
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveAgent(listener, func(conn net.Conn) {
+		agent.ServeAgent(keyring, conn)
+		conn.Close()
+	})
+	return socket, keys
+}
+
+func TestFilteredAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, keys := testAgent(t, dir)
+
+	var tests = []struct {
+		description string
+		keys        []string
+		confirm     func(string) bool
+		list        []string
+		signs       []string
+	}{
+		{
+			"All keys are forwarded without a filter",
+			nil,
+			nil,
+			[]string{"work", "personal"},
+			[]string{"work", "personal"},
+		},
+		{
+			"Keys are selected by their comment",
+			[]string{"^work$"},
+			nil,
+			[]string{"work"},
+			[]string{"work"},
+		},
+		{
+			"Keys are selected by their fingerprint",
+			[]string{ssh.FingerprintSHA256(keys["personal"])},
+			nil,
+			[]string{"personal"},
+			[]string{"personal"},
+		},
+		{
+			"Signatures that are confirmed are allowed",
+			[]string{"work"},
+			func(string) bool { return true },
+			[]string{"work"},
+			[]string{"work"},
+		},
+		{
+			"Signatures that are denied are refused",
+			nil,
+			func(prompt string) bool { return !strings.Contains(prompt, "personal") },
+			[]string{"work", "personal"},
+			[]string{"work"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			filter, err := compileSSHKeys(test.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			go serveFiltered(server, socket, filter, test.confirm)
+			a := agent.NewClient(client)
+
+			listed, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := []string{}
+			for _, k := range listed {
+				list = append(list, k.Comment)
+			}
+			signs := []string{}
+			for _, comment := range []string{"work", "personal"} {
+				if _, err := a.Sign(keys[comment], []byte("data")); err == nil {
+					signs = append(signs, comment)
+				}
+			}
+
+			if !reflect.DeepEqual(list, test.list) {
+				t.Errorf("got keys %q want %q", list, test.list)
+			}
+			if !reflect.DeepEqual(signs, test.signs) {
+				t.Errorf("got signatures with %q want %q", signs, test.signs)
+			}
+			if err := a.RemoveAll(); err == nil {
+				t.Errorf("got no error want keys to not be removable")
+			}
+		})
+	}
+}
+
+func TestCompileSSHKeys(t *testing.T) {
+	if _, err := compileSSHKeys([]string{"SHA256:+abc", "work|ci"}); err != nil {
+		t.Errorf("got %v want fingerprints and regexes to be valid", err)
+	}
+	if _, err := compileSSHKeys([]string{"("}); err == nil {
+		t.Errorf("got no error want an error for an invalid regex")
+	}
+}
+
+func TestCheckConfirm(t *testing.T) {
+	var tests = []struct {
+		description string
+		askpass     string
+		terminal    bool
+		ok          bool
+	}{
+		{
+			"SSH_ASKPASS works in a terminal",
+			"/usr/bin/ssh-askpass",
+			true,
+			true,
+		},
+		{
+			"The terminal can't be shared with the container",
+			"",
+			true,
+			false,
+		},
+		{
+			"The terminal can be used when the container isn't attached to it",
+			"",
+			false,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := checkConfirm(test.askpass, test.terminal)
+
+			if (err == nil) != test.ok {
+				t.Errorf("got error %v want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestReadAnswer(t *testing.T) {
+	var tests = []struct {
+		description string
+		input       string
+		want        string
+	}{
+		{
+			"Answers end with a newline",
+			"y\n",
+			"y",
+		},
+		{
+			"Answers end with a carriage return in raw mode",
+			"Yes\r",
+			"yes",
+		},
+		{
+			"No answer is empty",
+			"",
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := readAnswer(bufio.NewReader(strings.NewReader(test.input)))
+
+			if got != test.want {
+				t.Errorf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
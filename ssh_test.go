@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHForward(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	dir, err := ioutil.TempDir("", "lope-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	agent, _ := testAgent(t, dir)
+
+	var tests = []struct {
+		description string
+		ssh         bool
+		authSock    string
+		keys        []string
+		want        string
+		err         string
+	}{
+		{
+			"Nothing is forwarded without -ssh",
+			false,
+			agent,
+			nil,
+			"",
+			"",
+		},
+		{
+			"The socket of the agent is mounted directly on linux",
+			true,
+			agent,
+			nil,
+			agent,
+			"",
+		},
+		{
+			"Filtered agents are relayed",
+			true,
+			agent,
+			[]string{"work"},
+			"ssh-agent.sock",
+			"",
+		},
+		{
+			"A missing agent is reported",
+			true,
+			"",
+			nil,
+			"",
+			"SSH_AUTH_SOCK is not set",
+		},
+		{
+			"An agent that doesn't answer is reported",
+			true,
+			filepath.Join(dir, "gone.sock"),
+			nil,
+			"",
+			"doesn't answer",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			os.Setenv("SSH_AUTH_SOCK", test.authSock)
+			l := &lope{cfg: &config{ssh: test.ssh, sshKeys: test.keys, sshTimeout: 200 * time.Millisecond, os: "linux"}}
+			defer l.cleanup()
+
+			err := l.sshForward()
+
+			if test.err == "" && err != nil {
+				t.Fatalf("got error %v want none", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v want an error containing %q", err, test.err)
+			}
+			if filepath.Base(l.sshAgent) != filepath.Base(test.want) {
+				t.Errorf("got %q want %q", l.sshAgent, test.want)
+			}
+		})
+	}
+}
+
+func TestRelayAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The agent echoes everything back
+	agent := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveAgent(listener, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+
+	l := &lope{cfg: &config{}}
+	socket, err := l.relayAgent(func(conn net.Conn) {
+		relay(conn, agent)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if string(got) != "ping" {
+		t.Errorf("got %q want %q", got, "ping")
+	}
+
+	l.cleanup()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("got %v want the socket to be removed", err)
+	}
+}
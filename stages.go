@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stage is a single image/command combination in a pipeline defined in the
+// config file. Anything that isn't set is inherited from the top level config.
+type stage struct {
+	Name         string   `yaml:"name"`
+	Image        string   `yaml:"image"`
+	Command      string   `yaml:"command"`
+	Instructions []string `yaml:"instructions"`
+	Env          []string `yaml:"env"`
+	Blacklist    []string `yaml:"blacklist"`
+	// Artifacts are copied out of the container once the stage has finished
+	Artifacts []string `yaml:"artifacts"`
+	// Inputs are artifacts from earlier stages which are copied into the
+	// container before the command is started
+	Inputs []string `yaml:"inputs"`
+}
+
+// config returns a copy of base with the stage specific settings applied
+func (s *stage) config(base *config) *config {
+	c := *base
+	if s.Image != "" {
+		c.sourceImage = os.ExpandEnv(s.Image)
+	}
+	if s.Command != "" {
+		c.cmd = []string{s.Command}
+	}
+	if len(s.Instructions) > 0 {
+		c.instructions = s.Instructions
+	}
+	if len(s.Env) > 0 {
+		c.whitelist = s.Env
+	}
+	if len(s.Blacklist) > 0 {
+		c.blacklist = s.Blacklist
+	}
+	return &c
+}
+
+// selectStages returns the stages that should be run. If name is empty the
+// whole pipeline is returned, otherwise the named stage together with the
+// earlier stages that produce its inputs.
+func selectStages(stages []stage, name string) ([]stage, error) {
+	names := make([]string, 0)
+	artifacts := make(map[string]bool)
+	for _, s := range stages {
+		if s.Name == "" {
+			return nil, fmt.Errorf("every stage needs a name")
+		}
+		for _, n := range names {
+			if n == s.Name {
+				return nil, fmt.Errorf("stage %q is defined more than once", s.Name)
+			}
+		}
+		names = append(names, s.Name)
+		for _, i := range s.Inputs {
+			if !artifacts[artifactKey(i)] {
+				return nil, fmt.Errorf("input %q of stage %q is not an artifact of an earlier stage", i, s.Name)
+			}
+		}
+		for _, a := range s.Artifacts {
+			artifacts[artifactKey(a)] = true
+		}
+	}
+
+	if name == "" {
+		return stages, nil
+	}
+	target := -1
+	for i, s := range stages {
+		if s.Name == name {
+			target = i
+		}
+	}
+	if target == -1 {
+		return nil, fmt.Errorf("unknown stage %q, available stages are: %v", name, strings.Join(names, ", "))
+	}
+
+	// The stages that produce the inputs of the named stage are run before it,
+	// and so on for their own inputs
+	selected := []stage{stages[target]}
+	needed := make(map[string]bool)
+	for _, i := range stages[target].Inputs {
+		needed[artifactKey(i)] = true
+	}
+	for i := target - 1; i >= 0 && len(needed) > 0; i-- {
+		produces := false
+		for _, a := range stages[i].Artifacts {
+			if needed[artifactKey(a)] {
+				produces = true
+				delete(needed, artifactKey(a))
+			}
+		}
+		if !produces {
+			continue
+		}
+		for _, input := range stages[i].Inputs {
+			needed[artifactKey(input)] = true
+		}
+		selected = append([]stage{stages[i]}, selected...)
+	}
+	return selected, nil
+}
+
+// runPipeline runs the stages in order and stops at the first one that fails
+func runPipeline(base *config, stages []stage, name string) error {
+	selected, err := selectStages(stages, name)
+	if err != nil {
+		return &exitError{Code: exitConfig, Err: err}
+	}
+
+	store, err := newArtifactStore(base.containerRuntime)
+	if err != nil {
+		return err
+	}
+	defer store.remove()
+	interrupted, stop := pipelineSignals()
+	defer stop()
+
+	for _, s := range selected {
+		cfg := s.config(base)
+		if cfg.sourceImage == "" || len(cfg.cmd) == 0 {
+			return &exitError{Code: exitConfig, Err: fmt.Errorf("stage %q needs an image and a command", s.Name)}
+		}
+		cfg.exitCleanup = store.remove
+		if err := interrupted(); err != nil {
+			return fmt.Errorf("stage %q not started: %w", s.Name, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "lope: running stage %q\n", s.Name)
+		if err := runStage(cfg, s, store); err != nil {
+			return fmt.Errorf("stage %q failed: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// runStage runs a single stage. Stages that pass artifacts around are created
+// first so the inputs can be copied in, and kept after they exit so the
+// artifacts can be copied out. This works without any bind mounts so it is
+// also supported together with -noMount and -addMount.
+func runStage(cfg *config, s stage, store *artifactStore) error {
+	if len(s.Inputs) == 0 && len(s.Artifacts) == 0 {
+		return execute(cfg)
+	}
+
+	lope := lope{
+		cfg:    cfg,
+		envs:   os.Environ(),
+		params: make([]string, 0),
+		name:   "lope-" + randomID(),
+		create: true,
+	}
+	defer lope.cleanup()
+	stop := lope.handleSignals()
+	defer stop()
+
+	params, err := lope.prepare()
+	if err != nil {
+		return err
+	}
+
+	rt := cfg.containerRuntime
+	if err := rt.Create(params, lope.runEnv); err != nil {
+		return err
+	}
+	lope.addCleanup(func() {
+		rt.Remove(lope.name)
+	})
+
+	if err := lope.start(); err != nil {
+		return err
+	}
+
+	for _, i := range s.Inputs {
+		if err := store.inject(lope.name, cfg.workDir, i); err != nil {
+			return err
+		}
+	}
+
+	if err := rt.Start(lope.name); err != nil {
+		return err
+	}
+
+	for _, a := range s.Artifacts {
+		if err := store.save(lope.name, cfg.workDir, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
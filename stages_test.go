@@ -0,0 +1,243 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestStageConfig(t *testing.T) {
+	base := &config{
+		sourceImage:  "alpine",
+		cmd:          []string{"ls"},
+		instructions: []string{"RUN echo base"},
+		whitelist:    []string{"^AWS"},
+		blacklist:    []string{"HOME"},
+	}
+
+	var tests = []struct {
+		description string
+		stage       stage
+		want        config
+	}{
+		{
+			"A stage without settings inherits everything",
+			stage{Name: "empty"},
+			*base,
+		},
+		{
+			"Stage settings override the base config",
+			stage{
+				Name:         "build",
+				Image:        "golang",
+				Command:      "go build",
+				Instructions: []string{"RUN echo build"},
+				Env:          []string{"^GO"},
+				Blacklist:    []string{"PATH"},
+			},
+			config{
+				sourceImage:  "golang",
+				cmd:          []string{"go build"},
+				instructions: []string{"RUN echo build"},
+				whitelist:    []string{"^GO"},
+				blacklist:    []string{"PATH"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := test.stage.config(base)
+
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectStages(t *testing.T) {
+	stages := []stage{
+		{Name: "build"},
+		{Name: "test"},
+	}
+
+	var tests = []struct {
+		description string
+		stages      []stage
+		name        string
+		want        []stage
+		err         bool
+	}{
+		{
+			"All stages are run when no name is given",
+			stages,
+			"",
+			stages,
+			false,
+		},
+		{
+			"Only the named stage is run",
+			stages,
+			"test",
+			[]stage{{Name: "test"}},
+			false,
+		},
+		{
+			"Unknown stages are an error",
+			stages,
+			"deploy",
+			nil,
+			true,
+		},
+		{
+			"Stages need a name",
+			[]stage{{Image: "alpine"}},
+			"",
+			nil,
+			true,
+		},
+		{
+			"Stage names need to be unique",
+			[]stage{{Name: "build"}, {Name: "build"}},
+			"",
+			nil,
+			true,
+		},
+		{
+			"Inputs need to be artifacts of an earlier stage",
+			[]stage{{Name: "test", Inputs: []string{"bin/app"}}, {Name: "build", Artifacts: []string{"bin/app"}}},
+			"",
+			nil,
+			true,
+		},
+		{
+			"Inputs can use artifacts of an earlier stage",
+			[]stage{{Name: "build", Artifacts: []string{"./bin/app"}}, {Name: "test", Inputs: []string{"bin/app"}}},
+			"",
+			[]stage{{Name: "build", Artifacts: []string{"./bin/app"}}, {Name: "test", Inputs: []string{"bin/app"}}},
+			false,
+		},
+		{
+			"The stages that produce the inputs of the named stage are run too",
+			[]stage{
+				{Name: "deps", Artifacts: []string{"vendor"}},
+				{Name: "lint"},
+				{Name: "build", Inputs: []string{"vendor"}, Artifacts: []string{"bin/app"}},
+				{Name: "test", Inputs: []string{"./bin/app"}},
+			},
+			"test",
+			[]stage{
+				{Name: "deps", Artifacts: []string{"vendor"}},
+				{Name: "build", Inputs: []string{"vendor"}, Artifacts: []string{"bin/app"}},
+				{Name: "test", Inputs: []string{"./bin/app"}},
+			},
+			false,
+		},
+		{
+			"Only the last stage that produces an input is run",
+			[]stage{
+				{Name: "build", Artifacts: []string{"bin/app"}},
+				{Name: "rebuild", Artifacts: []string{"bin/app"}},
+				{Name: "test", Inputs: []string{"bin/app"}},
+			},
+			"test",
+			[]stage{
+				{Name: "rebuild", Artifacts: []string{"bin/app"}},
+				{Name: "test", Inputs: []string{"bin/app"}},
+			},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := selectStages(test.stages, test.name)
+
+			if (err != nil) != test.err {
+				t.Errorf("got error %v want error %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	stages := []stage{
+		{Name: "lint", Command: "gofmt -l ."},
+		{Name: "build", Command: "go build", Artifacts: []string{"bin/app"}},
+		{Name: "test", Command: "bin/app", Inputs: []string{"bin/app"}},
+	}
+
+	var tests = []struct {
+		description string
+		name        string
+		failRun     int
+		want        []string
+		exit        int
+	}{
+		{
+			"Every stage is run in order and artifacts are passed on",
+			"",
+			0,
+			[]string{
+				"run",
+				"create", "start lope-x", "cp from lope-x /lope/bin/app", "rm lope-x",
+				"create", "cp to lope-x", "start lope-x", "rm lope-x",
+			},
+			0,
+		},
+		{
+			"Running a stage runs the stages that produce its inputs",
+			"test",
+			0,
+			[]string{
+				"create", "start lope-x", "cp from lope-x /lope/bin/app", "rm lope-x",
+				"create", "cp to lope-x", "start lope-x", "rm lope-x",
+			},
+			0,
+		},
+		{
+			"A failing stage aborts the pipeline",
+			"",
+			1,
+			[]string{"run"},
+			3,
+		},
+		{
+			"Artifacts of a failing stage aren't copied",
+			"",
+			2,
+			[]string{"run", "create", "start lope-x", "rm lope-x"},
+			3,
+		},
+	}
+
+	names := regexp.MustCompile(`lope-[0-9a-f]+`)
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rt := &fakeRuntime{failRun: test.failRun}
+			base := &config{
+				containerRuntime: rt,
+				sourceImage:      "golang",
+				root:             true,
+				workDir:          "/lope",
+			}
+
+			err := runPipeline(base, stages, test.name)
+
+			got := []string{}
+			for _, call := range rt.calls {
+				got = append(got, names.ReplaceAllString(call, "lope-x"))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got calls %q want %q", got, test.want)
+			}
+			if code := exitCode(err); code != test.exit {
+				t.Errorf("got exit code %d want %d (%v)", code, test.exit, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	slashpath "path"
+)
+
+// filesPath is the prefix of the URLs of the file transfer endpoints of the
+// command proxy. The name of the directory and the path inside of it follow,
+// like /files/dist/app.tar.
+const filesPath = "/files/"
+
+// modeHeader carries the permissions of a file so that executables stay
+// executable when they are copied
+const modeHeader = "X-Lope-Mode"
+
+// transferDir is a directory on the host that files can be copied to and from
+// with lope-cp. The container refers to it by its name.
+type transferDir struct {
+	name string
+	host string
+}
+
+// parseTransferDirs parses the values of -cmdProxyDir which are either a path
+// or a name and a path separated by =. Without a name the name of the
+// directory is used. Relative paths are relative to the current directory.
+func parseTransferDirs(values []string) ([]transferDir, error) {
+	dirs := []transferDir{}
+	names := make(map[string]bool)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		d := transferDir{host: parts[len(parts)-1]}
+		if len(parts) == 2 {
+			d.name = parts[0]
+		}
+		if d.host == "" {
+			return nil, fmt.Errorf("command proxy directory %q needs a path", v)
+		}
+		host, err := filepath.Abs(d.host)
+		if err != nil {
+			return nil, err
+		}
+		d.host = host
+		if d.name == "" {
+			d.name = filepath.Base(host)
+		}
+		if strings.ContainsAny(d.name, `/\:`) {
+			return nil, fmt.Errorf("command proxy directory names can't contain /, \\ or :, got %q", d.name)
+		}
+		if names[d.name] {
+			return nil, fmt.Errorf("command proxy directory %q is used more than once", d.name)
+		}
+		names[d.name] = true
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// resolve returns the path on the host of a path inside of the directory.
+// Paths can't leave the directory, not even through a symlink.
+func (d transferDir) resolve(p string) (string, error) {
+	file := filepath.Join(d.host, filepath.FromSlash(slashpath.Clean("/"+p)))
+
+	root, err := filepath.EvalSymlinks(d.host)
+	if err != nil {
+		return "", err
+	}
+	// Check the part of the path that exists already, the rest is created
+	existing := file
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+				return "", fmt.Errorf("%q is outside of the directory %q", p, d.name)
+			}
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		existing = filepath.Dir(existing)
+	}
+}
+
+// transfer handles the upload of a file with PUT and its download with GET
+func (p *proxyServer) transfer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, filesPath), "/", 2)
+	name, rel := parts[0], ""
+	if len(parts) == 2 {
+		rel = parts[1]
+	}
+
+	action := map[string]string{"PUT": "upload", "GET": "download"}[r.Method]
+	entry := auditEntry{
+		Time:    time.Now(),
+		Command: copyCommand,
+		Args:    []string{action, name + ":" + rel},
+		Exit:    -1,
+	}
+	defer func() {
+		entry.DurationMs = time.Since(entry.Time).Nanoseconds() / int64(time.Millisecond)
+		p.audit.record(entry)
+	}()
+
+	if action == "" {
+		http.Error(w, "files can only be uploaded with PUT or downloaded with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	dir, ok := p.transferDir(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%q is not a directory the lope command proxy can copy files to or from", name), http.StatusNotFound)
+		return
+	}
+	entry.Allowed = true
+	file, err := dir.resolve(rel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	entry.HostDir = file
+
+	var n int64
+	if action == "upload" {
+		n, err = upload(file, r)
+		if err != nil {
+			debug(fmt.Sprintf("Command proxy failed to upload %q: %v\n", file, err))
+			http.Error(w, fmt.Sprintf("failed to upload %q: %v", name+":"+rel, err), 500)
+		}
+	} else {
+		n, err = download(file, w)
+	}
+	entry.OutputBytes = n
+	if err == nil {
+		entry.Exit = 0
+	}
+}
+
+func (p *proxyServer) transferDir(name string) (transferDir, bool) {
+	for _, d := range p.dirs {
+		if d.name == name {
+			return d, true
+		}
+	}
+	return transferDir{}, false
+}
+
+// upload writes the body of the request to a temporary file first so that a
+// failed upload doesn't leave a partial file behind
+func upload(file string, r *http.Request) (int64, error) {
+	mode := os.FileMode(0644)
+	if m, err := strconv.ParseUint(r.Header.Get(modeHeader), 8, 32); err == nil {
+		mode = os.FileMode(m).Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".lope-cp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r.Body)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func download(file string, w http.ResponseWriter) (int64, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("%q doesn't exist", filepath.Base(file)), http.StatusNotFound)
+		return 0, err
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return 0, err
+	}
+	if info.IsDir() {
+		http.Error(w, fmt.Sprintf("%q is a directory, only files can be downloaded", filepath.Base(file)), http.StatusBadRequest)
+		return 0, fmt.Errorf("%q is a directory", file)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set(modeHeader, fmt.Sprintf("%o", info.Mode().Perm()))
+	return io.Copy(w, f)
+}
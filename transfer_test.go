@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTransferDirs(t *testing.T) {
+	pwd, _ := os.Getwd()
+
+	var tests = []struct {
+		description string
+		values      []string
+		want        []transferDir
+		err         bool
+	}{
+		{
+			"Directories are named after the directory by default",
+			[]string{"/tmp/dist"},
+			[]transferDir{{name: "dist", host: filepath.FromSlash("/tmp/dist")}},
+			false,
+		},
+		{
+			"Names can be set and relative paths are made absolute",
+			[]string{"out=build/out"},
+			[]transferDir{{name: "out", host: filepath.Join(pwd, "build", "out")}},
+			false,
+		},
+		{
+			"Names have to be unique",
+			[]string{"/a/dist", "/b/dist"},
+			nil,
+			true,
+		},
+		{
+			"Names can't contain a colon",
+			[]string{"a:b=/tmp"},
+			nil,
+			true,
+		},
+		{
+			"A path is required",
+			[]string{"dist="},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseTransferDirs(test.values)
+
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v want error %v", err, test.err)
+			}
+			if !test.err && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyServerTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lope-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dist := filepath.Join(dir, "dist")
+	os.Mkdir(dist, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	os.Symlink(dir, filepath.Join(dist, "escape"))
+
+	p, err := newProxyServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.dirs = []transferDir{{name: "dist", host: dist}}
+
+	var tests = []struct {
+		description string
+		method      string
+		path        string
+		body        string
+		want        int
+		wantBody    string
+	}{
+		{
+			"Files are uploaded into the directory",
+			"PUT",
+			"/files/dist/release/app.sh",
+			"#!/bin/sh",
+			http.StatusOK,
+			"",
+		},
+		{
+			"Uploaded files can be downloaded again",
+			"GET",
+			"/files/dist/release/app.sh",
+			"",
+			http.StatusOK,
+			"#!/bin/sh",
+		},
+		{
+			"Only configured directories can be used",
+			"GET",
+			"/files/etc/passwd",
+			"",
+			http.StatusNotFound,
+			"\"etc\" is not a directory the lope command proxy can copy files to or from\n",
+		},
+		{
+			"Paths can't leave the directory",
+			"GET",
+			"/files/dist/../secret",
+			"",
+			http.StatusNotFound,
+			"\"secret\" doesn't exist\n",
+		},
+		{
+			"Paths can't leave the directory through a symlink",
+			"PUT",
+			"/files/dist/escape/secret",
+			"overwritten",
+			http.StatusForbidden,
+			"\"escape/secret\" is outside of the directory \"dist\"\n",
+		},
+		{
+			"Directories can't be downloaded",
+			"GET",
+			"/files/dist/release",
+			"",
+			http.StatusBadRequest,
+			"\"release\" is a directory, only files can be downloaded\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			req.URL.Path = test.path
+			req.Header.Set("Authorization", "Bearer "+p.token)
+			req.Header.Set(modeHeader, "755")
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("got status %d want %d", w.Code, test.want)
+			}
+			if got := w.Body.String(); got != test.wantBody {
+				t.Errorf("got %q want %q", got, test.wantBody)
+			}
+		})
+	}
+
+	info, err := os.Stat(filepath.Join(dist, "release", "app.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("got mode %v want %v", info.Mode().Perm(), os.FileMode(0755))
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(b) != "secret" {
+		t.Errorf("got %q want the file outside of the directory to be unchanged", b)
+	}
+}
+
+func TestAllowProxyCommandsForCopy(t *testing.T) {
+	c := &config{cmdProxyDirs: []string{"/tmp/dist"}}
+
+	c.allowProxyCommands()
+
+	if !c.cmdProxy {
+		t.Errorf("got cmdProxy %v want %v", c.cmdProxy, true)
+	}
+	if len(c.cmdProxyAllow) != 0 {
+		t.Errorf("got %+v want no allowed commands", c.cmdProxyAllow)
+	}
+}
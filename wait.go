@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+)
+
+// Backoff of waitFor. The first retry is quick since most things are ready
+// almost right away, later retries back off so they don't hammer anything.
+var (
+	waitInitial = 100 * time.Millisecond
+	waitMax     = 2 * time.Second
+)
+
+// waitFor calls check until it succeeds or timeout passed, doubling the time
+// between the attempts. It returns the error of the last attempt.
+func waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	delay := waitInitial
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if delay > left {
+			delay = left
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > waitMax {
+			delay = waitMax
+		}
+	}
+}
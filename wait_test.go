@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	var tests = []struct {
+		description string
+		failures    int
+		timeout     time.Duration
+		attempts    int
+		err         bool
+	}{
+		{
+			"Checks that succeed right away are only run once",
+			0,
+			time.Second,
+			1,
+			false,
+		},
+		{
+			"Failed checks are retried",
+			2,
+			time.Second,
+			3,
+			false,
+		},
+		{
+			"The last error is returned after the timeout",
+			100,
+			250 * time.Millisecond,
+			3,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			attempts := 0
+			err := waitFor(test.timeout, func() error {
+				attempts++
+				if attempts <= test.failures {
+					return errors.New("not ready")
+				}
+				return nil
+			})
+
+			if (err != nil) != test.err {
+				t.Errorf("got error %v want error %v", err, test.err)
+			}
+			if attempts != test.attempts {
+				t.Errorf("got %d attempts want %d", attempts, test.attempts)
+			}
+		})
+	}
+}